@@ -22,32 +22,27 @@ import (
 	_ "github.com/anabiozz/rproxy/pkg/provider/all"
 	"github.com/anabiozz/rproxy/pkg/provider/docker"
 	"github.com/anabiozz/rproxy/pkg/provider/file"
-	httprouter "github.com/anabiozz/rproxy/pkg/router/net"
 	"github.com/spf13/viper"
 )
 
-func newProxyListener(url string, logger log.Logger) net.Listener {
+func newProxyListener(url string) (net.Listener, error) {
 
 	addr, err := net.ResolveTCPAddr("tcp", url)
 	if err != nil {
-		logger.Error(err)
+		return nil, err
 	}
 
 	ln, err := net.Listen("tcp4", addr.String())
 	if err != nil {
-		logger.Error(err)
 		ln, err = net.Listen("tcp6", addr.String())
-		if err != nil {
-			logger.Error(err)
-		}
 	}
-	return ln
+	return ln, err
 }
 
 func listenFunc(ln net.Listener) func(network, laddr string) (net.Listener, error) {
 	return func(network, laddr string) (net.Listener, error) {
-		if network != "tcp" {
-			fmt.Printf("got Listen call with network %q, not tcp\n", network)
+		if network != ln.Addr().Network() {
+			fmt.Printf("got Listen call with network %q, not %s\n", network, ln.Addr().Network())
 			return nil, errors.New("invalid network")
 		}
 		return ln, nil
@@ -110,52 +105,18 @@ func main() {
 	// # Provider
 	// ################################################################
 
-	config := dynamic.Configuration{}
-
 	providerConfigurationCh := make(chan *dynamic.Configuration, 100)
 	errorCh := make(chan error)
-	config.Services = make(map[string]*dynamic.Service)
 
 	go createProviders(ctx, cfg.Providers, providerConfigurationCh, logger)
 
-	go func(ctx context.Context, logger log.Logger) {
-		select {
-		case providercfg := <-providerConfigurationCh:
-
-			for serviceName, service := range providercfg.Services {
-
-				for _, server := range service.Servers {
-
-					go func(server dynamic.Server, serviceName string, logger log.Logger) {
-
-						endpoint := (*cfg.EntryPoints)[serviceName]
-
-						front := newProxyListener(endpoint.Address, logger)
-						defer front.Close()
-
-						proxy := &httprouter.Proxy{
-							ListenFunc: listenFunc(front),
-						}
-
-						proxy.AddRoute(endpoint.Address, &httprouter.DialProxy{
-							Addr: server.URL,
-						})
-
-						if err := proxy.Start(ctx); err != nil {
-							logger.Error(err)
-						}
-
-						for {
-						}
-
-					}(server, serviceName, logger)
-				}
-			}
+	// ################################################################
+	// # Reconciler
+	// ################################################################
 
-		case err := <-errorCh:
-			logger.Error(err)
-		}
-	}(ctx, logger)
+	runCtx, stopRun := context.WithCancel(ctx)
+	reconciler := newReconciler(ctx, &cfg, logger)
+	go reconciler.run(runCtx, providerConfigurationCh, errorCh)
 
 	logger.Info("SERVICE STARTED")
 	defer logger.Info("SERVICE ENDED")
@@ -180,4 +141,12 @@ func main() {
 	}()
 
 	logger.Info(<-errs)
+	stopRun()
+
+	logger.Infof("SHUTTING DOWN, WAITING UP TO %v FOR ACTIVE CONNECTIONS", cfg.GraceTimeout())
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.GraceTimeout())
+	defer cancel()
+	if err := reconciler.shutdown(shutdownCtx); err != nil {
+		logger.Warnf("connections force-closed: %v", err)
+	}
 }
@@ -0,0 +1,509 @@
+// Copyright 2019 Bezrukov Alex. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/config/dynamic"
+	"github.com/anabiozz/rproxy/pkg/config/static"
+	"github.com/anabiozz/rproxy/pkg/log"
+	httprouter "github.com/anabiozz/rproxy/pkg/router/net"
+)
+
+// reconciler applies the dynamic configurations sent by the providers to
+// the running proxies. Every service is served on the entry point of the
+// same name, by a Proxy of its own. Each configuration received is the
+// whole desired state: services missing from it are stopped.
+type reconciler struct {
+	ctx          context.Context
+	entryPoints  static.EntryPoints
+	graceTimeout time.Duration // for the connections of stopped entry points
+	logger       log.Logger
+
+	mu      sync.Mutex
+	running map[string]*entryPoint // by service name
+	closed  bool
+
+	stopping    sync.WaitGroup     // stopped entry points still draining
+	stopCtx     context.Context    // of the draining entry points
+	cancelStops context.CancelFunc // force-closes their connections
+}
+
+// entryPoint is a running entry point and the service it serves.
+type entryPoint struct {
+	name     string // of the service, and of the entry point
+	address  string
+	proxy    *httprouter.Proxy    // for tcp entry points
+	udp      *httprouter.UDPProxy // for udp entry points
+	service  *dynamic.Service     // as last applied
+	balancer *httprouter.Balancer
+	cancel   context.CancelFunc // stops the balancer's health checks
+	stopTLS  context.CancelFunc // stops reloading the certificates, if any
+}
+
+// setBalancer sends the new connections or flows of ep to balancer, as
+// restricted by the service of ep.
+func (ep *entryPoint) setBalancer(balancer *httprouter.Balancer) {
+	if ep.udp != nil {
+		ep.udp.SetTarget(balancer)
+	} else {
+		route := httprouter.FixedRoute(balancer)
+		if ep.service.ClientCert != nil {
+			route = httprouter.ClientCertRoute(clientCertMatcher(ep.service.ClientCert), balancer)
+		}
+		ep.proxy.SetRoute(ep.address, ep.name, route)
+	}
+	ep.balancer = balancer
+}
+
+// close stops ep listening, leaving its connections be.
+func (ep *entryPoint) close() {
+	if ep.udp != nil {
+		ep.udp.Close()
+	} else {
+		ep.proxy.Close()
+	}
+}
+
+// shutdown gracefully shuts ep down and stops its background work.
+func (ep *entryPoint) shutdown(ctx context.Context) error {
+	defer ep.stopTLS()
+	defer ep.cancel()
+	defer ep.balancer.SetBackends(nil) // releases its circuit breakers
+
+	if ep.udp != nil {
+		return ep.udp.Shutdown(ctx)
+	}
+	return ep.proxy.Shutdown(ctx)
+}
+
+func newReconciler(ctx context.Context, cfg *static.Configuration, logger log.Logger) *reconciler {
+	r := &reconciler{
+		ctx:          ctx,
+		graceTimeout: cfg.GraceTimeout(),
+		logger:       logger,
+		running:      make(map[string]*entryPoint),
+	}
+	// Draining outlives ctx: shutdown waits for it, up to its own deadline.
+	r.stopCtx, r.cancelStops = context.WithCancel(context.Background())
+	if cfg.EntryPoints != nil {
+		r.entryPoints = *cfg.EntryPoints
+	}
+	return r
+}
+
+// run applies every configuration received on configs until ctx is done.
+func (r *reconciler) run(ctx context.Context, configs <-chan *dynamic.Configuration, errs <-chan error) {
+	for {
+		select {
+		case config := <-configs:
+			r.apply(config)
+		case err := <-errs:
+			r.logger.Error(err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// configChanges sums up what applying a configuration changed.
+type configChanges struct {
+	added, updated, removed, failed []string
+	unchanged                       int
+}
+
+func (c *configChanges) String() string {
+	sort.Strings(c.added)
+	sort.Strings(c.updated)
+	sort.Strings(c.removed)
+	sort.Strings(c.failed)
+	return fmt.Sprintf("added %v, updated %v, removed %v, failed %v, %d unchanged",
+		c.added, c.updated, c.removed, c.failed, c.unchanged)
+}
+
+// apply diffs config against the running entry points and starts, updates
+// and stops them accordingly. Connections already established are left
+// alone, except on stopped entry points which are shut down gracefully.
+func (r *reconciler) apply(config *dynamic.Configuration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || config == nil {
+		return
+	}
+
+	var changes configChanges
+	for name, service := range config.Services {
+		ep := r.running[name]
+		if ep != nil && reflect.DeepEqual(ep.service, service) {
+			changes.unchanged++
+			continue
+		}
+
+		var err error
+		if ep == nil {
+			err = r.start(name, service)
+		} else {
+			err = r.update(ep, service)
+		}
+		switch {
+		case err != nil:
+			r.logger.Errorf("service %s: %v", name, err)
+			changes.failed = append(changes.failed, name)
+		case ep == nil:
+			changes.added = append(changes.added, name)
+		default:
+			changes.updated = append(changes.updated, name)
+		}
+	}
+
+	for name, ep := range r.running {
+		if _, ok := config.Services[name]; ok {
+			continue
+		}
+		delete(r.running, name)
+		r.stop(ep)
+		changes.removed = append(changes.removed, name)
+	}
+
+	r.logger.Infof("configuration applied: %v", &changes)
+}
+
+// start opens the entry point of service name and serves it.
+func (r *reconciler) start(name string, service *dynamic.Service) error {
+	endpoint := r.entryPoints[name]
+	if endpoint == nil {
+		return fmt.Errorf("no entry point %q", name)
+	}
+	if service.LoadBalancer == nil {
+		return fmt.Errorf("no load balancer")
+	}
+	if err := checkClientCert(endpoint, service); err != nil {
+		return err
+	}
+
+	balancer, err := newBalancer(service)
+	if err != nil {
+		return err
+	}
+
+	network, address := endpoint.Network()
+	tlsCtx, stopTLS := context.WithCancel(r.ctx)
+	ep := &entryPoint{
+		name:    name,
+		address: address,
+		service: service,
+		stopTLS: stopTLS,
+	}
+	switch network {
+	case "tcp", "unix":
+		if network == "unix" {
+			// The Proxy tells unix sockets apart by their scheme.
+			ep.address = endpoint.Address
+		}
+		ep.proxy, err = newStreamProxy(tlsCtx, endpoint, network, address, ep.address)
+	case "udp":
+		if endpoint.TLS != nil {
+			err = fmt.Errorf("TLS termination on udp entry point")
+			break
+		}
+		if endpoint.Fallback != nil {
+			err = fmt.Errorf("fallback on udp entry point")
+			break
+		}
+		if err = checkUDPService(service); err != nil {
+			break
+		}
+		ep.udp = &httprouter.UDPProxy{Addr: address}
+		if endpoint.UDP != nil {
+			ep.udp.IdleTimeout = endpoint.UDP.Timeout
+		}
+	default:
+		err = fmt.Errorf("unknown network %q", network)
+	}
+	if err != nil {
+		stopTLS()
+		balancer.SetBackends(nil)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	balancer.StartHealthChecks(ctx)
+	ep.setBalancer(balancer)
+	ep.cancel = cancel
+
+	if ep.udp != nil {
+		err = ep.udp.Start(r.ctx)
+	} else {
+		err = ep.proxy.Start(r.ctx)
+	}
+	if err != nil {
+		cancel()
+		stopTLS()
+		balancer.SetBackends(nil)
+		if ep.proxy != nil {
+			ep.proxy.Close()
+		}
+		return err
+	}
+
+	r.running[name] = ep
+	return nil
+}
+
+// checkUDPService returns an error if service sets load balancer options
+// udp entry points don't support.
+func checkUDPService(service *dynamic.Service) error {
+	lb := service.LoadBalancer
+	switch {
+	case lb.HealthCheck != nil:
+		return fmt.Errorf("health check on udp entry point")
+	case lb.Retry != nil:
+		return fmt.Errorf("retry on udp entry point")
+	case lb.CircuitBreaker != nil:
+		return fmt.Errorf("circuit breaker on udp entry point")
+	case lb.OutlierDetection != nil:
+		return fmt.Errorf("outlier detection on udp entry point")
+	case lb.ProxyProtocol != nil:
+		return fmt.Errorf("PROXY protocol on udp entry point")
+	case lb.TLS != nil:
+		return fmt.Errorf("servers TLS on udp entry point")
+	case lb.IdleTimeout != 0 || lb.MaxLifetime != 0:
+		return fmt.Errorf("idle timeout or max lifetime on udp entry point; see udp.timeout")
+	case service.ClientCert != nil:
+		return fmt.Errorf("clientCert on udp entry point")
+	}
+	return nil
+}
+
+// newStreamProxy returns the Proxy of a tcp or unix entry point listening
+// on address, not started yet. Its routes are set for ipPort. Terminated
+// TLS certificates are reloaded until ctx is done.
+func newStreamProxy(ctx context.Context, endpoint *static.EntryPoint, network, address, ipPort string) (*httprouter.Proxy, error) {
+	var front net.Listener
+	var err error
+	if network == "unix" {
+		front, err = newUnixListener(address, endpoint.Unix)
+	} else {
+		front, err = newProxyListener(address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &httprouter.Proxy{
+		ListenFunc: listenFunc(front),
+	}
+	proxy.SetPeekTimeout(ipPort, endpoint.PeekTimeout)
+
+	if pp := endpoint.ProxyProtocol; pp != nil {
+		trustedIPs := pp.TrustedIPs
+		if pp.Insecure {
+			trustedIPs = []string{"0.0.0.0/0", "::/0"}
+		}
+		if err := proxy.AcceptProxyProtocol(ipPort, trustedIPs); err != nil {
+			front.Close()
+			return nil, err
+		}
+	}
+
+	if endpoint.TLS != nil {
+		config, err := newTLSConfig(ctx, endpoint.TLS)
+		if err != nil {
+			front.Close()
+			return nil, err
+		}
+		proxy.TerminateTLS(ipPort, config)
+	}
+
+	if endpoint.Fallback != nil {
+		fallback, err := newFallback(endpoint)
+		if err != nil {
+			front.Close()
+			return nil, err
+		}
+		proxy.SetFallback(ipPort, fallback)
+	}
+	return proxy, nil
+}
+
+// newFallback builds the target of the connections matching no route of
+// endpoint.
+func newFallback(endpoint *static.EntryPoint) (httprouter.Target, error) {
+	cfg := endpoint.Fallback
+	set := 0
+	for _, isSet := range []bool{cfg.Address != "", cfg.Sink, cfg.HTTPStatus != 0, cfg.TLSAlert} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("fallback sets more than one of address, sink, httpStatus and tlsAlert")
+	}
+	if cfg.Timeout != 0 && !cfg.Sink {
+		return nil, fmt.Errorf("fallback timeout without sink")
+	}
+	if cfg.TLSAlert && endpoint.TLS != nil {
+		// Its clients are past the handshake.
+		return nil, fmt.Errorf("fallback tlsAlert on entry point terminating TLS")
+	}
+
+	switch {
+	case cfg.Address != "":
+		return &httprouter.DialProxy{Addr: cfg.Address}, nil
+	case cfg.Sink:
+		return httprouter.Sink{Timeout: cfg.Timeout}, nil
+	case cfg.HTTPStatus != 0:
+		if http.StatusText(cfg.HTTPStatus) == "" {
+			return nil, fmt.Errorf("unknown fallback HTTP status %d", cfg.HTTPStatus)
+		}
+		return httprouter.Respond{Payload: httprouter.HTTPErrorResponse(cfg.HTTPStatus)}, nil
+	case cfg.TLSAlert:
+		return httprouter.Respond{Payload: httprouter.TLSAlert(httprouter.TLSAlertUnrecognizedName)}, nil
+	}
+	return nil, fmt.Errorf("empty fallback")
+}
+
+// update applies the new configuration of the service served by ep. Server
+// list changes are applied to the running balancer, keeping the state of
+// the servers left as they were; other changes replace the balancer.
+func (r *reconciler) update(ep *entryPoint, service *dynamic.Service) error {
+	if service.LoadBalancer == nil {
+		return fmt.Errorf("no load balancer")
+	}
+	if ep.udp != nil {
+		if err := checkUDPService(service); err != nil {
+			return err
+		}
+	}
+	if err := checkClientCert(r.entryPoints[ep.name], service); err != nil {
+		return err
+	}
+
+	if sameButServers(ep.service, service) {
+		backends, err := newBackends(service)
+		if err != nil {
+			return err
+		}
+		ep.balancer.SetBackends(reuseBackends(ep.balancer.Backends(), backends))
+		ep.service = service
+		return nil
+	}
+
+	balancer, err := newBalancer(service)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	balancer.StartHealthChecks(ctx)
+	old := ep.balancer
+	ep.service = service
+	ep.setBalancer(balancer)
+	old.SetBackends(nil) // releases its circuit breakers
+
+	ep.cancel()
+	ep.cancel = cancel
+	return nil
+}
+
+// sameButServers reports whether a and b only differ by their servers.
+func sameButServers(a, b *dynamic.Service) bool {
+	if a.LoadBalancer == nil || b.LoadBalancer == nil {
+		return false
+	}
+	lbA, lbB := *a.LoadBalancer, *b.LoadBalancer
+	lbA.Servers, lbB.Servers = nil, nil
+	serviceA, serviceB := *a, *b
+	serviceA.LoadBalancer, serviceB.LoadBalancer = &lbA, &lbB
+	return reflect.DeepEqual(serviceA, serviceB)
+}
+
+// reuseBackends returns backends with every backend also found in running,
+// same address and weight, replaced by the running one.
+func reuseBackends(running, backends []*httprouter.Backend) []*httprouter.Backend {
+	used := make(map[*httprouter.Backend]bool, len(running))
+	for i, backend := range backends {
+		for _, old := range running {
+			if !used[old] && old.Addr == backend.Addr && old.Weight == backend.Weight {
+				backends[i] = old
+				used[old] = true
+				break
+			}
+		}
+	}
+	return backends
+}
+
+// stop closes the listener of ep right away, so that its address can be
+// reused, then shuts ep down in the background, waiting for its
+// connections up to the grace timeout.
+func (r *reconciler) stop(ep *entryPoint) {
+	ep.close()
+
+	r.stopping.Add(1)
+	go func() {
+		defer r.stopping.Done()
+
+		ctx, cancel := context.WithTimeout(r.stopCtx, r.graceTimeout)
+		defer cancel()
+
+		if err := ep.shutdown(ctx); err != nil {
+			r.logger.Warnf("service %s: connections force-closed: %v", ep.name, err)
+		}
+	}()
+}
+
+// awaitStops waits for the stopped entry points to finish draining. If ctx
+// expires first, their remaining connections are closed and ctx's error
+// returned.
+func (r *reconciler) awaitStops(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.stopping.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.cancelStops()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// shutdown gracefully shuts down all entry points concurrently, along with
+// those still draining, returning the first error. No configuration is
+// applied afterwards.
+func (r *reconciler) shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	errc := make(chan error, len(r.running))
+	for _, ep := range r.running {
+		go func(ep *entryPoint) {
+			errc <- ep.shutdown(ctx)
+		}(ep)
+	}
+
+	firstErr := r.awaitStops(ctx)
+	for range r.running {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Bezrukov Alex. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/config/dynamic"
+	"github.com/anabiozz/rproxy/pkg/config/static"
+	"github.com/anabiozz/rproxy/pkg/log"
+	httprouter "github.com/anabiozz/rproxy/pkg/router/net"
+)
+
+func newService(strategy string, urls ...string) *dynamic.Service {
+	lb := &dynamic.LoadBalancer{Strategy: strategy}
+	for _, url := range urls {
+		lb.Servers = append(lb.Servers, dynamic.Server{URL: url, Weight: 1})
+	}
+	return &dynamic.Service{LoadBalancer: lb}
+}
+
+func TestSameButServers(t *testing.T) {
+	withHealthCheck := newService("", "a:1")
+	withHealthCheck.HealthCheck = &dynamic.HealthCheck{Interval: time.Second}
+
+	tests := []struct {
+		name string
+		a, b *dynamic.Service
+		want bool
+	}{
+		{"equal", newService("", "a:1"), newService("", "a:1"), true},
+		{"servers", newService("", "a:1"), newService("", "a:1", "b:1"), true},
+		{"no servers", newService("", "a:1"), newService(""), true},
+		{"strategy", newService("", "a:1"), newService("least-conn", "a:1"), false},
+		{"health check", newService("", "a:1"), withHealthCheck, false},
+		{"client cert", newService("", "a:1"), &dynamic.Service{
+			LoadBalancer: newService("", "a:1").LoadBalancer,
+			ClientCert:   &dynamic.ClientCert{},
+		}, false},
+		{"no load balancer", newService("", "a:1"), &dynamic.Service{}, false},
+	}
+	for _, tt := range tests {
+		if got := sameButServers(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameButServers = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReuseBackends(t *testing.T) {
+	backend := func(addr string, weight int) *httprouter.Backend {
+		return &httprouter.Backend{DialProxy: &httprouter.DialProxy{Addr: addr}, Weight: weight}
+	}
+	a, b, a2 := backend("a:1", 1), backend("b:1", 1), backend("a:1", 1)
+
+	tests := []struct {
+		name     string
+		running  []*httprouter.Backend
+		backends []*httprouter.Backend
+		want     []*httprouter.Backend
+	}{
+		{"kept", []*httprouter.Backend{a, b}, []*httprouter.Backend{backend("b:1", 1), backend("a:1", 1)}, []*httprouter.Backend{b, a}},
+		{"added", []*httprouter.Backend{a}, []*httprouter.Backend{backend("a:1", 1), b}, []*httprouter.Backend{a, b}},
+		{"removed", []*httprouter.Backend{a, b}, []*httprouter.Backend{backend("b:1", 1)}, []*httprouter.Backend{b}},
+		{"weight changed", []*httprouter.Backend{a}, []*httprouter.Backend{b, backend("a:1", 2)}, nil},
+		{"duplicates", []*httprouter.Backend{a}, []*httprouter.Backend{backend("a:1", 1), a2}, []*httprouter.Backend{a, a2}},
+	}
+	for _, tt := range tests {
+		got := reuseBackends(tt.running, tt.backends)
+		if tt.want == nil {
+			// Nothing to reuse: the new backends are kept as they are.
+			tt.want = tt.backends
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d backends; want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: backend %d is %s, not the expected one", tt.name, i, got[i].Addr)
+			}
+		}
+	}
+}
+
+func TestReconcilerUpdate(t *testing.T) {
+	withHealthCheck := newService("", "a:1")
+	withHealthCheck.HealthCheck = &dynamic.HealthCheck{Interval: time.Second}
+	withRetry := newService("", "a:1")
+	withRetry.Retry = &dynamic.Retry{Attempts: 2}
+	withBreaker := newService("", "a:1")
+	withBreaker.CircuitBreaker = &dynamic.CircuitBreaker{ConsecutiveFailures: 5}
+	withOutlier := newService("", "a:1")
+	withOutlier.OutlierDetection = &dynamic.OutlierDetection{ConsecutiveFailures: 5}
+	withProxyProtocol := newService("", "a:1")
+	withProxyProtocol.ProxyProtocol = &dynamic.ProxyProtocol{Version: 2}
+	withTLS := newService("", "a:1")
+	withTLS.TLS = &dynamic.ServersTLS{}
+	withIdleTimeout := newService("", "a:1")
+	withIdleTimeout.IdleTimeout = time.Minute
+	withClientCert := newService("", "a:1")
+	withClientCert.ClientCert = &dynamic.ClientCert{}
+
+	tests := []struct {
+		name        string
+		service     *dynamic.Service
+		sameBalance bool // the running balancer is kept
+		wantErr     bool
+	}{
+		{"servers", newService("", "a:1", "b:1"), true, false},
+		{"strategy", newService("least-conn", "a:1"), false, false},
+		{"health check on udp", withHealthCheck, true, true},
+		{"retry on udp", withRetry, true, true},
+		{"circuit breaker on udp", withBreaker, true, true},
+		{"outlier detection on udp", withOutlier, true, true},
+		{"proxy protocol on udp", withProxyProtocol, true, true},
+		{"tls on udp", withTLS, true, true},
+		{"idle timeout on udp", withIdleTimeout, true, true},
+		{"client cert on udp", withClientCert, true, true},
+	}
+	for _, tt := range tests {
+		r := newReconciler(context.Background(), &static.Configuration{}, log.WithContext(context.Background()))
+		old := newService("", "a:1")
+		balancer, err := newBalancer(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		running := balancer.Backends()[0]
+		ep := &entryPoint{
+			name:    tt.name,
+			udp:     &httprouter.UDPProxy{},
+			service: old,
+			cancel:  func() {},
+			stopTLS: func() {},
+		}
+		ep.setBalancer(balancer)
+
+		err = r.update(ep, tt.service)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: update error = %v; want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got := ep.balancer == balancer; got != tt.sameBalance {
+			t.Errorf("%s: balancer kept = %v; want %v", tt.name, got, tt.sameBalance)
+		}
+		if tt.sameBalance && !tt.wantErr && ep.balancer.Backends()[0] != running {
+			t.Errorf("%s: running backend was replaced", tt.name)
+		}
+		if tt.wantErr && ep.service != old {
+			t.Errorf("%s: failed update was applied", tt.name)
+		}
+	}
+}
+
+func TestReconcilerStartClientCert(t *testing.T) {
+	service := newService("", "a:1")
+	service.ClientCert = &dynamic.ClientCert{Subjects: []string{"client"}}
+
+	cfg := &static.Configuration{EntryPoints: &static.EntryPoints{
+		"plain":  {Address: "127.0.0.1:0"},
+		"no-cas": {Address: "127.0.0.1:0", TLS: &static.TLS{}},
+	}}
+	r := newReconciler(context.Background(), cfg, log.WithContext(context.Background()))
+	for name := range *cfg.EntryPoints {
+		if err := r.start(name, service); err == nil {
+			r.stop(r.running[name])
+			t.Errorf("%s: started a service with clientCert", name)
+		}
+	}
+}
+
+func TestNewFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     static.Fallback
+		tls     *static.TLS
+		wantErr bool
+	}{
+		{"address", static.Fallback{Address: "127.0.0.1:8080"}, nil, false},
+		{"sink", static.Fallback{Sink: true, Timeout: time.Second}, nil, false},
+		{"http status", static.Fallback{HTTPStatus: 421}, nil, false},
+		{"tls alert", static.Fallback{TLSAlert: true}, nil, false},
+		{"empty", static.Fallback{}, nil, true},
+		{"unknown http status", static.Fallback{HTTPStatus: 999}, nil, true},
+		{"address and sink", static.Fallback{Address: "127.0.0.1:8080", Sink: true}, nil, true},
+		{"http status and tls alert", static.Fallback{HTTPStatus: 421, TLSAlert: true}, nil, true},
+		{"timeout without sink", static.Fallback{HTTPStatus: 421, Timeout: time.Second}, nil, true},
+		{"http status with tls", static.Fallback{HTTPStatus: 421}, &static.TLS{}, false},
+		{"tls alert with tls", static.Fallback{TLSAlert: true}, &static.TLS{}, true},
+	}
+	for _, tt := range tests {
+		endpoint := &static.EntryPoint{TLS: tt.tls, Fallback: &tt.cfg}
+		if _, err := newFallback(endpoint); (err != nil) != tt.wantErr {
+			t.Errorf("%s: newFallback error = %v; want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReconcilerStop(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			// Hold the connection open until the proxy closes it.
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := &static.Configuration{
+		EntryPoints:          &static.EntryPoints{"web": {Address: addr}},
+		ShutdownGraceTimeout: time.Minute,
+	}
+	r := newReconciler(context.Background(), cfg, log.WithContext(context.Background()))
+	r.apply(&dynamic.Configuration{Services: map[string]*dynamic.Service{
+		"web": newService("", backend.Addr().String()),
+	}})
+	ep := r.running["web"]
+	if ep == nil {
+		t.Fatal("web was not started")
+	}
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address is free as soon as the service is removed, while its
+	// connection still drains.
+	r.apply(&dynamic.Configuration{})
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("address still in use after stop: %v", err)
+	}
+	ln.Close()
+	if n := ep.proxy.ActiveConns(); n != 1 {
+		t.Fatalf("ActiveConns = %d; want the draining connection", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown = %v; want %v", err, context.DeadlineExceeded)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("read after shutdown = %v; want %v", err, io.EOF)
+	}
+}
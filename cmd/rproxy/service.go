@@ -0,0 +1,94 @@
+// Copyright 2019 Bezrukov Alex. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/anabiozz/rproxy/pkg/config/dynamic"
+	httprouter "github.com/anabiozz/rproxy/pkg/router/net"
+)
+
+// newBalancer builds the target spreading connections over the servers
+// of service.
+func newBalancer(service *dynamic.Service) (*httprouter.Balancer, error) {
+	backends, err := newBackends(service)
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := httprouter.NewBalancer(service.Strategy, backends)
+	if err != nil {
+		return nil, err
+	}
+	if retry := service.Retry; retry != nil {
+		balancer.Retry = &httprouter.Retry{
+			Attempts:       retry.Attempts,
+			InitialBackoff: retry.InitialInterval,
+			MaxBackoff:     retry.MaxInterval,
+		}
+	}
+	if hc := service.HealthCheck; hc != nil {
+		balancer.HealthCheck = &httprouter.HealthCheck{
+			Interval:           hc.Interval,
+			Timeout:            hc.Timeout,
+			Rise:               hc.Rise,
+			Fall:               hc.Fall,
+			Send:               []byte(hc.Send),
+			Expect:             []byte(hc.Expect),
+			TLS:                hc.TLS,
+			ServerName:         hc.ServerName,
+			InsecureSkipVerify: hc.InsecureSkipVerify,
+		}
+	}
+	if od := service.OutlierDetection; od != nil {
+		balancer.OutlierDetection = &httprouter.OutlierDetection{
+			ConsecutiveFailures: od.ConsecutiveFailures,
+			BaseEjectionTime:    od.BaseEjectionTime,
+			MaxEjectionTime:     od.MaxEjectionTime,
+			MaxEjectionPercent:  od.MaxEjectionPercent,
+		}
+	}
+	return balancer, nil
+}
+
+// newBackends builds the backends of a balancer for the servers of
+// service.
+func newBackends(service *dynamic.Service) ([]*httprouter.Backend, error) {
+	var tlsConfig *tls.Config
+	if service.TLS != nil {
+		var err error
+		if tlsConfig, err = newServersTLSConfig(service.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	backends := make([]*httprouter.Backend, 0, len(service.Servers))
+	for _, server := range service.Servers {
+		dialProxy := &httprouter.DialProxy{
+			Addr:        server.URL,
+			IdleTimeout: service.IdleTimeout,
+			MaxLifetime: service.MaxLifetime,
+			TLSConfig:   tlsConfig,
+		}
+		if service.ProxyProtocol != nil {
+			dialProxy.ProxyProtocolVersion = service.ProxyProtocol.Version
+		}
+		if cb := service.CircuitBreaker; cb != nil {
+			dialProxy.CircuitBreaker = &httprouter.CircuitBreaker{
+				ConsecutiveFailures: cb.ConsecutiveFailures,
+				FailureRatio:        cb.FailureRatio,
+				MinRequests:         cb.MinRequests,
+				Window:              cb.Window,
+				OpenTimeout:         cb.OpenTimeout,
+				HalfOpenProbes:      cb.HalfOpenProbes,
+			}
+		}
+		backends = append(backends, &httprouter.Backend{
+			DialProxy: dialProxy,
+			Weight:    server.Weight,
+		})
+	}
+	return backends, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Bezrukov Alex. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/config/dynamic"
+	"github.com/anabiozz/rproxy/pkg/config/static"
+	httprouter "github.com/anabiozz/rproxy/pkg/router/net"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersion returns the TLS version named like "1.2", or 1.2 if name is
+// empty.
+func tlsVersion(name string) (uint16, error) {
+	if name == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return v, nil
+}
+
+// newServersTLSConfig builds the TLS configuration of the connections to
+// the servers of a service.
+func newServersTLSConfig(cfg *dynamic.ServersTLS) (*tls.Config, error) {
+	minVersion, err := tlsVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         minVersion,
+	}
+	if cfg.CAFile != "" {
+		if config.RootCAs, err = loadCAs(cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newTLSConfig builds the TLS configuration terminating TLS on an entry
+// point. Its certificates are reloaded when they change on disk, until
+// ctx is done.
+func newTLSConfig(ctx context.Context, cfg *static.TLS) (*tls.Config, error) {
+	minVersion, err := tlsVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	store := httprouter.NewCertStore()
+	for _, cert := range cfg.Certificates {
+		if err := store.AddFile(cert.CertFile, cert.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range cfg.Directories {
+		if err := store.AddDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Default != nil {
+		if err := store.SetDefault(cfg.Default.CertFile, cfg.Default.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	interval := cfg.ReloadInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go store.Watch(ctx, interval)
+
+	config := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     minVersion,
+	}
+	if len(cfg.ClientCAFiles) > 0 {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.ClientCAs, err = loadCAs(cfg.ClientCAFiles...); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// loadCAs returns a pool of the certificates of the PEM bundles files.
+func loadCAs(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// checkClientCert returns an error if service restricts the client
+// certificates of endpoint, but endpoint doesn't ask clients for one.
+func checkClientCert(endpoint *static.EntryPoint, service *dynamic.Service) error {
+	if service.ClientCert == nil {
+		return nil
+	}
+	if endpoint == nil || endpoint.TLS == nil || len(endpoint.TLS.ClientCAFiles) == 0 {
+		return fmt.Errorf("clientCert on entry point without tls.clientCAFiles")
+	}
+	return nil
+}
+
+// clientCertMatcher returns the matcher of the client certificates
+// accepted by cfg.
+func clientCertMatcher(cfg *dynamic.ClientCert) httprouter.ClientCertMatcher {
+	var matchers []httprouter.ClientCertMatcher
+	for _, subject := range cfg.Subjects {
+		matchers = append(matchers, httprouter.SubjectMatcher(subject))
+	}
+	for _, san := range cfg.SANs {
+		matchers = append(matchers, httprouter.SANMatcher(san))
+	}
+	for _, id := range cfg.SPIFFEIDs {
+		matchers = append(matchers, httprouter.SPIFFEIDMatcher(id))
+	}
+	return func(ctx context.Context, cert *x509.Certificate) bool {
+		if len(matchers) == 0 {
+			return true
+		}
+		for _, matcher := range matchers {
+			if matcher(ctx, cert) {
+				return true
+			}
+		}
+		return false
+	}
+}
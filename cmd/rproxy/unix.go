@@ -0,0 +1,90 @@
+// Copyright 2019 Bezrukov Alex. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/config/static"
+)
+
+// newUnixListener listens on the unix socket path, an abstract socket if
+// it starts with "@", and applies the file settings of opts to it.
+func newUnixListener(path string, opts *static.Unix) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		removeStaleSocket(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil || abstract || opts == nil {
+		return ln, err
+	}
+	if err := setSocketFile(path, opts); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing listens
+// on it anymore, as left by an unclean exit.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// setSocketFile sets the mode and owner of the socket file at path.
+func setSocketFile(path string, opts *static.Unix) error {
+	if opts.Mode != "" {
+		mode, err := strconv.ParseUint(opts.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %q", opts.Mode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if opts.User == "" && opts.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if opts.User != "" {
+		u, err := user.Lookup(opts.User)
+		if err != nil {
+			u, err = user.LookupId(opts.User)
+		}
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if opts.Group != "" {
+		g, err := user.LookupGroup(opts.Group)
+		if err != nil {
+			g, err = user.LookupGroupId(opts.Group)
+		}
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -1,5 +1,7 @@
 package dynamic
 
+import "time"
+
 // Configuration ..
 type Configuration struct {
 	Routers  map[string]*Router
@@ -14,14 +16,110 @@ type Router struct {
 // Service ..
 type Service struct {
 	*LoadBalancer
+	// ClientCert optionally restricts the service to clients with a
+	// matching certificate, verified by a TLS entry point. The entry point
+	// must set clientCAFiles.
+	ClientCert *ClientCert
+}
+
+// ClientCert holds which client certificates a service accepts: those
+// matching any of the listed identities, or any verified one if none is
+// listed.
+type ClientCert struct {
+	// Subjects are subject common names.
+	Subjects []string
+	// SANs are DNS (wildcards allowed), email, IP or URI subject
+	// alternative names.
+	SANs []string
+	// SPIFFEIDs are SPIFFE IDs; "spiffe://example.org/*" accepts a whole
+	// trust domain.
+	SPIFFEIDs []string
 }
 
 // LoadBalancer ..
 type LoadBalancer struct {
 	Servers []Server
+	// Strategy is the balancing strategy: round-robin (default),
+	// weighted-round-robin, least-conn, random-two-choices, or one of the
+	// session affinity strategies source-ip-hash and sni-hash.
+	Strategy         string
+	ProxyProtocol    *ProxyProtocol
+	Retry            *Retry
+	CircuitBreaker   *CircuitBreaker
+	HealthCheck      *HealthCheck
+	OutlierDetection *OutlierDetection
+	// IdleTimeout and MaxLifetime optionally bound the sessions proxied
+	// to the servers.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// TLS optionally makes connections to the servers use TLS.
+	TLS *ServersTLS
+}
+
+// ServersTLS holds how connections to the servers are encrypted.
+type ServersTLS struct {
+	// ServerName verifies the server certificates; the default is the
+	// host of each server URL. Servers on unix sockets need it.
+	ServerName string
+	// CAFile is a PEM bundle of the CAs trusted to sign the server
+	// certificates, instead of the system ones.
+	CAFile string
+	// CertFile and KeyFile are an optional client certificate.
+	CertFile           string
+	KeyFile            string
+	MinVersion         string
+	InsecureSkipVerify bool
+}
+
+// Retry holds how failed dials are retried on the other servers.
+type Retry struct {
+	Attempts        int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+}
+
+// CircuitBreaker holds when dials to a server are short-circuited.
+type CircuitBreaker struct {
+	ConsecutiveFailures int
+	FailureRatio        float64
+	MinRequests         int
+	Window              time.Duration
+	OpenTimeout         time.Duration
+	HalfOpenProbes      int
+}
+
+// ProxyProtocol holds the PROXY protocol header sent to the servers.
+type ProxyProtocol struct {
+	Version int
 }
 
 // Server ..
 type Server struct {
-	URL string
+	// URL is the host:port of the server, or its unix socket path as
+	// "unix:///run/app.sock".
+	URL    string
+	Weight int
+}
+
+// HealthCheck holds the active health checks of the servers.
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+	// Send and Expect are optional byte patterns written to and expected
+	// from the server.
+	Send               string
+	Expect             string
+	TLS                bool
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// OutlierDetection holds when servers failing sessions are ejected.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  int
 }
@@ -1,6 +1,9 @@
 package static
 
 import (
+	"strings"
+	"time"
+
 	"github.com/anabiozz/rproxy/pkg/provider/docker"
 	"github.com/anabiozz/rproxy/pkg/provider/file"
 )
@@ -9,6 +12,17 @@ import (
 type Configuration struct {
 	Providers   *Providers
 	EntryPoints *EntryPoints
+	// ShutdownGraceTimeout is how long active connections are waited for
+	// on shutdown before being closed.
+	ShutdownGraceTimeout time.Duration `toml:"shutdownGraceTimeout,omitempty"`
+}
+
+// GraceTimeout returns ShutdownGraceTimeout, defaulting to 10 seconds.
+func (cfg *Configuration) GraceTimeout() time.Duration {
+	if cfg.ShutdownGraceTimeout > 0 {
+		return cfg.ShutdownGraceTimeout
+	}
+	return 10 * time.Second
 }
 
 // EntryPoints holds the HTTP entry point list.
@@ -22,5 +36,96 @@ type Providers struct {
 
 // EntryPoint holds the entry point configuration.
 type EntryPoint struct {
+	// Address is the address to listen on, optionally followed by the
+	// protocol: ":53/udp". The default is tcp. Unix sockets are written
+	// "unix:///run/app.sock", or "unix://@name" for abstract ones.
+	Address       string         `toml:"address,omitempty"`
+	ProxyProtocol *ProxyProtocol `toml:"proxyProtocol,omitempty"`
+	// PeekTimeout bounds the wait for the first bytes routes match on.
+	PeekTimeout time.Duration `toml:"peekTimeout,omitempty"`
+	UDP         *UDP          `toml:"udp,omitempty"`
+	Unix        *Unix         `toml:"unix,omitempty"`
+	// TLS makes the entry point terminate TLS and route the plaintext.
+	TLS *TLS `toml:"tls,omitempty"`
+	// Fallback handles the connections no route matches, which are
+	// closed otherwise.
+	Fallback *Fallback `toml:"fallback,omitempty"`
+}
+
+// Network splits Address into the network of the entry point, tcp, udp
+// or unix, and the address to listen on.
+func (ep *EntryPoint) Network() (network, address string) {
+	if strings.HasPrefix(ep.Address, "unix://") {
+		return "unix", strings.TrimPrefix(ep.Address, "unix://")
+	}
+	if i := strings.LastIndex(ep.Address, "/"); i >= 0 {
+		return strings.ToLower(ep.Address[i+1:]), ep.Address[:i]
+	}
+	return "tcp", ep.Address
+}
+
+// Unix holds the socket file settings of a unix entry point. They don't
+// apply to abstract sockets.
+type Unix struct {
+	// Mode is the octal permission of the socket file, like "0660".
+	Mode string `toml:"mode,omitempty"`
+	// User and Group own the socket file, by name or numeric id.
+	User  string `toml:"user,omitempty"`
+	Group string `toml:"group,omitempty"`
+}
+
+// TLS holds the TLS termination of an entry point. Certificates are
+// picked by SNI, wildcards included, falling back to Default.
+type TLS struct {
+	Certificates []*Certificate `toml:"certificates,omitempty"`
+	// Directories hold PEM files: name.crt or name.pem with name.key, or
+	// name.pem holding both.
+	Directories []string     `toml:"directories,omitempty"`
+	Default     *Certificate `toml:"default,omitempty"`
+	// MinVersion is the oldest TLS version accepted, "1.0" to "1.3". The
+	// default is 1.2.
+	MinVersion string `toml:"minVersion,omitempty"`
+	// ReloadInterval is how often the certificate files are checked for
+	// changes. The default is 10 seconds.
+	ReloadInterval time.Duration `toml:"reloadInterval,omitempty"`
+	// ClientCAFiles makes the entry point require client certificates
+	// signed by one of the CAs of these PEM bundles.
+	ClientCAFiles []string `toml:"clientCAFiles,omitempty"`
+}
+
+// Certificate holds the PEM files of a certificate and its key.
+type Certificate struct {
+	CertFile string `toml:"certFile,omitempty"`
+	KeyFile  string `toml:"keyFile,omitempty"`
+}
+
+// Fallback holds what connections matching no route of a tcp or unix
+// entry point get. Exactly one of its settings must be set.
+type Fallback struct {
+	// Address forwards them to a server, as host:port or unix://path.
 	Address string `toml:"address,omitempty"`
+	// Sink reads and discards what they send, for at most Timeout.
+	Sink    bool          `toml:"sink,omitempty"`
+	Timeout time.Duration `toml:"timeout,omitempty"`
+	// HTTPStatus answers them an HTTP error response, like 421 or 502.
+	HTTPStatus int `toml:"httpStatus,omitempty"`
+	// TLSAlert answers them a fatal unrecognized_name TLS alert. It can't
+	// be used on entry points terminating TLS.
+	TLSAlert bool `toml:"tlsAlert,omitempty"`
+}
+
+// UDP holds the configuration of a udp entry point. Its service may only
+// set servers and a strategy: the other load balancer options and
+// clientCert apply to streams.
+type UDP struct {
+	// Timeout ends client flows idle for that long.
+	Timeout time.Duration `toml:"timeout,omitempty"`
+}
+
+// ProxyProtocol holds the PROXY protocol configuration of an entry point.
+type ProxyProtocol struct {
+	// TrustedIPs lists the IPs and CIDRs allowed to send a PROXY header.
+	TrustedIPs []string `toml:"trustedIPs,omitempty"`
+	// Insecure trusts PROXY headers from any source.
+	Insecure bool `toml:"insecure,omitempty"`
 }
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"bufio"
+	"context"
+)
+
+// AddALPNRoute appends a route to the ipPort listener that routes to
+// dest if the TLS ClientHello offers the ALPN protocol proto, like "h2"
+// or "acme-tls/1", and sni is empty or matches its SNI server name as in
+// AddSNIRoute. Clients usually offer several protocols and the first
+// matching route wins, so add the routes of the preferred protocols
+// first.
+//
+// On listeners terminating TLS (see TerminateTLS), proto is matched
+// against the protocol negotiated by the handshake instead, which the
+// TLS configuration must list in NextProtos.
+func (proxy *Proxy) AddALPNRoute(ipPort, sni, proto string, dest Target) {
+	proxy.addRoute(ipPort, ALPNRoute(sni, proto, dest))
+}
+
+// ALPNRoute returns the Route of AddALPNRoute, for use with SetRoute.
+func ALPNRoute(sni, proto string, dest Target) Route {
+	m := alpnMatch{proto: proto, target: dest}
+	if sni != "" {
+		m.sni = hostNameMatcher(sni)
+	}
+	return m
+}
+
+type alpnMatch struct {
+	sni    Matcher // nil matches any server name
+	proto  string
+	target Target
+}
+
+func (m alpnMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	if conn.TLS == nil {
+		hello := clientHello(br)
+		if hello == nil {
+			return nil
+		}
+		conn.HostName = hello.ServerName
+		conn.ALPN = hello.SupportedProtos
+	}
+	if m.sni != nil && !m.sni(ctx, conn.HostName) {
+		return nil
+	}
+	for _, proto := range conn.ALPN {
+		if proto == m.proto {
+			return m.target
+		}
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing strategies of a Balancer.
+const (
+	RoundRobin         = "round-robin"
+	WeightedRoundRobin = "weighted-round-robin"
+	LeastConn          = "least-conn"
+	RandomTwoChoices   = "random-two-choices"
+)
+
+// ErrNoBackend is reported to OnDialError when a Balancer has no backend
+// to send a connection to.
+var ErrNoBackend = errors.New("no backend available")
+
+// Backend is a server of a Balancer.
+type Backend struct {
+	*DialProxy
+	// Weight is the share of connections the backend gets relative to the
+	// others, for the weighted strategies. Values below 1 count as 1.
+	Weight int
+
+	conns     int64 // active connections, accessed atomically
+	unhealthy int32 // set by failed health checks, accessed atomically
+	current   int   // smooth weighted round-robin state
+	outlier   outlierState
+}
+
+func (backend *Backend) weight() int {
+	if backend.Weight > 0 {
+		return backend.Weight
+	}
+	return 1
+}
+
+// Conns returns the number of connections currently proxied to backend.
+func (backend *Backend) Conns() int64 {
+	return atomic.LoadInt64(&backend.conns)
+}
+
+// Balancer is a Target spreading connections over the backends of a
+// service according to a balancing strategy.
+type Balancer struct {
+	// OnDialError is called when no backend could be dialed. If nil, the
+	// OnDialError of the last backend tried is used.
+	OnDialError func(src net.Conn, dstDialErr error)
+
+	// Retry optionally retries failed dials on the other backends. The
+	// client connection is held open meanwhile.
+	Retry *Retry
+
+	// HealthCheck optionally configures active health checks, run from
+	// StartHealthChecks.
+	HealthCheck *HealthCheck
+
+	// OutlierDetection optionally ejects backends failing sessions.
+	OutlierDetection *OutlierDetection
+
+	mu       sync.RWMutex // guards backends and the health check state
+	backends []*Backend   // replaced as a whole by SetBackends
+	checks   healthChecks
+
+	strategy  strategy
+	retries   *retryQueue
+	outlierMu sync.Mutex
+}
+
+type strategy interface {
+	pick(src net.Conn, backends []*Backend) *Backend
+}
+
+// memberStrategy is a strategy that also depends on all the backends of
+// its balancer, not only on those it picks from.
+type memberStrategy interface {
+	setBackends(backends []*Backend)
+}
+
+// NewBalancer returns a Balancer over backends using the named strategy.
+// An empty strategy means RoundRobin.
+func NewBalancer(strategyName string, backends []*Backend) (*Balancer, error) {
+	strategy, err := newStrategy(strategyName)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := strategy.(memberStrategy); ok {
+		s.setBackends(backends)
+	}
+	retainBreakers(backends)
+	return &Balancer{
+		backends: backends,
+		strategy: strategy,
+		retries:  newRetryQueue(),
+	}, nil
+}
+
+func newStrategy(name string) (strategy, error) {
+	switch name {
+	case "", RoundRobin:
+		return &roundRobin{}, nil
+	case WeightedRoundRobin:
+		return &weightedRoundRobin{}, nil
+	case LeastConn:
+		return leastConn{}, nil
+	case RandomTwoChoices:
+		return &twoChoices{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case SourceIPHash:
+		return &consistentHash{key: sourceIPKey}, nil
+	case SNIHash:
+		return &consistentHash{key: sniKey}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", name)
+}
+
+// Backends returns the backends of balancer.
+func (balancer *Balancer) Backends() []*Backend {
+	balancer.mu.RLock()
+	defer balancer.mu.RUnlock()
+	return balancer.backends
+}
+
+// SetBackends replaces the backends of balancer. It is safe to call while
+// balancer handles connections: those already proxied stay up, and new
+// ones are spread over backends. A *Backend also found in the previous
+// set keeps its state (connections, health, ejection); removed backends
+// stop being health checked and new ones start to be. Circuit breakers
+// of addresses no balancer uses anymore are dropped, so a balancer being
+// discarded should be set no backends.
+func (balancer *Balancer) SetBackends(backends []*Backend) {
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+
+	retainBreakers(backends)
+	releaseBreakers(balancer.backends)
+	balancer.backends = append([]*Backend(nil), backends...)
+	if s, ok := balancer.strategy.(memberStrategy); ok {
+		s.setBackends(balancer.backends)
+	}
+	balancer.checks.sync(balancer.HealthCheck, balancer.backends)
+}
+
+// available returns the backends that may get new connections.
+func (balancer *Balancer) available() []*Backend {
+	backends := balancer.Backends()
+	available := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.Healthy() && !backend.Ejected() && !backend.circuitOpen() {
+			available = append(available, backend)
+		}
+	}
+	return available
+}
+
+func (balancer *Balancer) onDialError(last *Backend) func(src net.Conn, dstDialErr error) {
+	if balancer.OnDialError != nil {
+		return balancer.OnDialError
+	}
+	if last != nil {
+		return last.onDialError()
+	}
+	return func(src net.Conn, dstDialErr error) {
+		fmt.Printf("for incoming conn %v, error picking backend: %v\n", src.RemoteAddr().String(), dstDialErr)
+		src.Close()
+	}
+}
+
+// HandleConn proxies src to the backend chosen by the balancing strategy,
+// moving on to other backends as configured by Retry if dialing fails.
+func (balancer *Balancer) HandleConn(ctx context.Context, src net.Conn) {
+	var tried []*Backend
+	for attempt := 1; ; attempt++ {
+		backend := balancer.strategy.pick(src, untried(balancer.available(), tried))
+		if backend == nil {
+			balancer.onDialError(nil)(src, ErrNoBackend)
+			return
+		}
+
+		atomic.AddInt64(&backend.conns, 1)
+		dst, err := backend.dial(ctx, src)
+		if err == nil {
+			s := backend.proxy(ctx, src, dst)
+			balancer.report(ctx, backend, failedSession(s))
+			atomic.AddInt64(&backend.conns, -1)
+			return
+		}
+		atomic.AddInt64(&backend.conns, -1)
+		if err != ErrCircuitOpen {
+			// A short-circuited dial says nothing new of the backend.
+			balancer.report(ctx, backend, true)
+		}
+
+		if balancer.Retry == nil || attempt > balancer.Retry.Attempts {
+			balancer.onDialError(backend)(src, err)
+			return
+		}
+
+		fmt.Printf("for incoming conn %v, error dialing %q (attempt %d): %v; retrying\n", src.RemoteAddr().String(), backend.Addr, attempt, err)
+		tried = append(tried, backend)
+
+		if err := balancer.wait(ctx, balancer.Retry.backoff(attempt)); err != nil {
+			balancer.onDialError(backend)(src, err)
+			return
+		}
+	}
+}
+
+// wait blocks for delay, unless ctx is done first.
+func (balancer *Balancer) wait(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	id, ready := balancer.retries.schedule(delay)
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		balancer.retries.cancel(id)
+		return ctx.Err()
+	}
+}
+
+// untried returns the backends not in tried, or all of them once every
+// backend has been tried.
+func untried(backends, tried []*Backend) []*Backend {
+	if len(tried) == 0 {
+		return backends
+	}
+	left := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if !containsBackend(tried, backend) {
+			left = append(left, backend)
+		}
+	}
+	if len(left) == 0 {
+		return backends
+	}
+	return left
+}
+
+func containsBackend(backends []*Backend, backend *Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (s *roundRobin) pick(src net.Conn, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backend := backends[s.next%len(backends)]
+	s.next = (s.next + 1) % len(backends)
+	return backend
+}
+
+// weightedRoundRobin is nginx's smooth weighted round-robin: each pick
+// raises every backend's current weight by its weight, and the highest
+// one is picked and lowered by the total.
+type weightedRoundRobin struct {
+	mu sync.Mutex
+}
+
+func (s *weightedRoundRobin) pick(src net.Conn, backends []*Backend) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, backend := range backends {
+		backend.current += backend.weight()
+		total += backend.weight()
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// leastConn picks the backend with the fewest active connections
+// relative to its weight.
+type leastConn struct{}
+
+func (leastConn) pick(src net.Conn, backends []*Backend) *Backend {
+	var best *Backend
+	for _, backend := range backends {
+		if best == nil || lessLoaded(backend, best) {
+			best = backend
+		}
+	}
+	return best
+}
+
+// lessLoaded reports whether a has fewer connections per weight than b.
+func lessLoaded(a, b *Backend) bool {
+	return a.Conns()*int64(b.weight()) < b.Conns()*int64(a.weight())
+}
+
+// twoChoices picks two backends at random and keeps the less loaded one.
+type twoChoices struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (s *twoChoices) pick(src net.Conn, backends []*Backend) *Backend {
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	s.mu.Lock()
+	i := s.rand.Intn(len(backends))
+	j := s.rand.Intn(len(backends) - 1)
+	s.mu.Unlock()
+
+	if j >= i {
+		j++
+	}
+	if lessLoaded(backends[j], backends[i]) {
+		return backends[j]
+	}
+	return backends[i]
+}
@@ -0,0 +1,291 @@
+package http
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func testBackends(weights ...int) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, weight := range weights {
+		backends[i] = &Backend{DialProxy: To(string(rune('a' + i))), Weight: weight}
+	}
+	return backends
+}
+
+func pickCounts(t *testing.T, strategyName string, backends []*Backend, n int) map[string]int {
+	s, err := newStrategy(strategyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[s.pick(nil, backends).Addr]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	counts := pickCounts(t, RoundRobin, testBackends(1, 5, 1), 9)
+	for addr, n := range counts {
+		if n != 3 {
+			t.Errorf("backend %s picked %d times; want 3", addr, n)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	s, _ := newStrategy(WeightedRoundRobin)
+
+	// Smooth weighted round-robin interleaves the heavy backend.
+	var got string
+	for i := 0; i < 7; i++ {
+		got += s.pick(nil, backends).Addr
+	}
+	if want := "aabacaa"; got != want {
+		t.Fatalf("got picks %q; want %q", got, want)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	backends := testBackends(1, 1, 2)
+	backends[0].conns = 2
+	backends[1].conns = 1
+	backends[2].conns = 3
+
+	for _, strategyName := range []string{LeastConn, RandomTwoChoices} {
+		counts := pickCounts(t, strategyName, backends, 100)
+		if counts["a"] != 0 {
+			t.Errorf("%s picked the most loaded backend %d times", strategyName, counts["a"])
+		}
+	}
+	if counts := pickCounts(t, LeastConn, backends, 1); counts["b"] != 1 {
+		t.Errorf("least-conn picked %v; want b", counts)
+	}
+}
+
+func TestBalancerSetBackends(t *testing.T) {
+	backends := testBackends(1, 1)
+	balancer, err := NewBalancer(RoundRobin, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends[0].conns = 1
+
+	// b is kept, with its state; a is removed and c added.
+	balancer.SetBackends([]*Backend{backends[1], {DialProxy: To("c")}})
+	got := balancer.Backends()
+	if len(got) != 2 || got[0] != backends[1] || got[1].Addr != "c" {
+		t.Fatalf("got backends %v", got)
+	}
+	for _, backend := range balancer.available() {
+		if backend.Addr == "a" {
+			t.Fatal("removed backend still available")
+		}
+	}
+}
+
+func testClient(i int) net.Conn {
+	return &Conn{remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 40000 + i}}
+}
+
+func TestSourceIPHash(t *testing.T) {
+	backends := testBackends(1, 1, 1, 1)
+	s := &consistentHash{key: sourceIPKey}
+	s.setBackends(backends)
+
+	const clients = 1000
+	before := make([]*Backend, clients)
+	for i := range before {
+		before[i] = s.pick(testClient(i), backends)
+		if again := s.pick(testClient(i), backends); again != before[i] {
+			t.Fatalf("client %d mapped to %s then %s", i, before[i].Addr, again.Addr)
+		}
+	}
+
+	// Removing a backend must only remap the clients it had.
+	removed := backends[1]
+	remaining := []*Backend{backends[0], backends[2], backends[3]}
+	s.setBackends(remaining)
+	for i := range before {
+		after := s.pick(testClient(i), remaining)
+		if before[i] != removed && after != before[i] {
+			t.Fatalf("client %d moved from %s to %s", i, before[i].Addr, after.Addr)
+		}
+	}
+}
+
+func TestHashSkipsUnavailable(t *testing.T) {
+	backends := testBackends(1, 1, 1, 1)
+	s := &consistentHash{key: sourceIPKey}
+	s.setBackends(backends)
+
+	const clients = 1000
+	before := make([]*Backend, clients)
+	for i := range before {
+		before[i] = s.pick(testClient(i), backends)
+	}
+
+	// Picking among some of the backends, as when one is down or was
+	// already tried, must not change the ring for the others.
+	down := backends[2]
+	available := []*Backend{backends[0], backends[1], backends[3]}
+	ring := s.ring
+	for i := range before {
+		after := s.pick(testClient(i), available)
+		if after == down {
+			t.Fatalf("client %d mapped to unavailable %s", i, down.Addr)
+		}
+		if before[i] != down && after != before[i] {
+			t.Fatalf("client %d moved from %s to %s", i, before[i].Addr, after.Addr)
+		}
+	}
+	if &s.ring[0] != &ring[0] {
+		t.Fatal("ring rebuilt for a subset of the backends")
+	}
+}
+
+func TestHashBoundedLoad(t *testing.T) {
+	backends := testBackends(1, 1)
+	s := &consistentHash{key: sourceIPKey}
+	s.setBackends(backends)
+
+	home := s.pick(testClient(0), backends)
+	home.conns = 10
+	if got := s.pick(testClient(0), backends); got == home {
+		t.Fatalf("overloaded backend %s still picked", home.Addr)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	b := breakerFor("breaker.test:1", &CircuitBreaker{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         time.Hour,
+	})
+
+	for i := 0; i < 2; i++ {
+		generation, ok := b.allow(ctx)
+		if !ok {
+			t.Fatalf("dial %d short-circuited while closed", i)
+		}
+		b.done(ctx, generation, false)
+	}
+	if _, ok := b.allow(ctx); ok {
+		t.Fatal("dial allowed after 2 consecutive failures")
+	}
+
+	// Once OpenTimeout passed, a single probe is let through and closes
+	// the breaker again.
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	generation, ok := b.allow(ctx)
+	if !ok {
+		t.Fatal("probe not allowed while half-open")
+	}
+	if _, ok := b.allow(ctx); ok {
+		t.Fatal("second concurrent probe allowed while half-open")
+	}
+	b.done(ctx, generation, true)
+	if b.state != breakerClosed {
+		t.Fatalf("breaker %s after a successful probe; want closed", b.state)
+	}
+}
+
+func TestBalancerCircuitBreakers(t *testing.T) {
+	ctx := context.Background()
+	cfg := &CircuitBreaker{ConsecutiveFailures: 1, OpenTimeout: time.Hour}
+	a := &Backend{DialProxy: &DialProxy{Addr: "breaker-a.test:1", CircuitBreaker: cfg}}
+	b := &Backend{DialProxy: &DialProxy{Addr: "breaker-b.test:1", CircuitBreaker: cfg}}
+	balancer, err := NewBalancer(RoundRobin, []*Backend{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backends whose breaker is open get no connections.
+	breaker := breakerFor(a.Addr, cfg)
+	generation, _ := breaker.allow(ctx)
+	breaker.done(ctx, generation, false)
+	if got := balancer.available(); len(got) != 1 || got[0] != b {
+		t.Fatalf("got %d available backends; want only %s", len(got), b.Addr)
+	}
+
+	// Breakers of addresses left by every balancer are forgotten.
+	balancer.SetBackends([]*Backend{b})
+	breakers.Lock()
+	_, ok := breakers.m[a.Addr]
+	breakers.Unlock()
+	if ok || breakerStates.Get(a.Addr) != nil || breakerTrips.Get(a.Addr) != nil {
+		t.Fatalf("breaker of %s kept after it left the balancer", a.Addr)
+	}
+	if breakerStates.Get(b.Addr) == nil {
+		t.Fatalf("breaker of %s dropped while in use", b.Addr)
+	}
+	balancer.SetBackends(nil)
+}
+
+func TestCircuitBreakerMinRequests(t *testing.T) {
+	ctx := context.Background()
+	b := breakerFor("breaker-ratio.test:1", &CircuitBreaker{FailureRatio: 0.5, OpenTimeout: time.Hour})
+
+	// The ratio is only looked at after 10 dials by default.
+	for i := 0; i < 9; i++ {
+		generation, ok := b.allow(ctx)
+		if !ok {
+			t.Fatalf("dial %d short-circuited after %d failures", i+1, i)
+		}
+		b.done(ctx, generation, false)
+	}
+	generation, _ := b.allow(ctx)
+	b.done(ctx, generation, false)
+	if _, ok := b.allow(ctx); ok {
+		t.Fatal("dial allowed after 10 failed dials")
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	ctx := context.Background()
+	balancer, err := NewBalancer(RoundRobin, testBackends(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer.OutlierDetection = &OutlierDetection{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Hour,
+		MaxEjectionTime:     24 * time.Hour,
+	}
+	a, b := balancer.backends[0], balancer.backends[1]
+
+	balancer.report(ctx, a, true)
+	balancer.report(ctx, a, false)
+	balancer.report(ctx, a, true)
+	if a.Ejected() {
+		t.Fatal("backend ejected after non-consecutive failures")
+	}
+	balancer.report(ctx, a, true)
+	if !a.Ejected() {
+		t.Fatal("backend not ejected after consecutive failures")
+	}
+
+	// Half of two backends may be ejected at once.
+	balancer.report(ctx, b, true)
+	balancer.report(ctx, b, true)
+	if b.Ejected() {
+		t.Fatal("ejection exceeded MaxEjectionPercent")
+	}
+	if got := balancer.available(); len(got) != 1 || got[0] != b {
+		t.Fatalf("got %d available backends; want only %s", len(got), b.Addr)
+	}
+
+	// The next ejection lasts twice as long.
+	a.outlier.ejectedUntil = 0
+	a.outlier.lastEjected = time.Now()
+	balancer.report(ctx, a, true)
+	balancer.report(ctx, a, true)
+	until := time.Unix(0, a.outlier.ejectedUntil)
+	if d := time.Until(until); d < 119*time.Minute || d > 2*time.Hour {
+		t.Fatalf("second ejection lasts %v; want 2h", d)
+	}
+}
@@ -0,0 +1,289 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/log"
+)
+
+// ErrCircuitOpen is returned when dialing a backend whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker configures the breaker guarding dials to a backend
+// address. Breakers are shared by all DialProxies to the same address.
+// Balancers send no connections to backends whose breaker is open.
+type CircuitBreaker struct {
+	// ConsecutiveFailures trips the breaker after this many failed dials
+	// in a row. Zero disables the check.
+	ConsecutiveFailures int
+	// FailureRatio trips the breaker when this share of the dials made
+	// within Window failed, once at least MinRequests (10 by default)
+	// were made. Zero disables the check.
+	FailureRatio float64
+	MinRequests  int
+	Window       time.Duration
+	// OpenTimeout is how long the breaker short-circuits dials before
+	// letting probes through.
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of probe dials that must succeed to
+	// close the breaker again.
+	HalfOpenProbes int
+}
+
+func (cfg *CircuitBreaker) window() time.Duration {
+	if cfg.Window > 0 {
+		return cfg.Window
+	}
+	return 10 * time.Second
+}
+
+func (cfg *CircuitBreaker) minRequests() int {
+	if cfg.MinRequests > 0 {
+		return cfg.MinRequests
+	}
+	return 10
+}
+
+func (cfg *CircuitBreaker) openTimeout() time.Duration {
+	if cfg.OpenTimeout > 0 {
+		return cfg.OpenTimeout
+	}
+	return 30 * time.Second
+}
+
+func (cfg *CircuitBreaker) halfOpenProbes() int {
+	if cfg.HalfOpenProbes > 0 {
+		return cfg.HalfOpenProbes
+	}
+	return 1
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerStates publishes the state of every breaker by address, and
+// breakerTrips how many times each one opened.
+var (
+	breakerStates = expvar.NewMap("circuit_breaker_states")
+	breakerTrips  = expvar.NewMap("circuit_breaker_trips")
+)
+
+type breaker struct {
+	addr string
+	refs int // balancer backends using the breaker, guarded by breakers
+
+	mu          sync.Mutex
+	cfg         *CircuitBreaker
+	state       breakerState
+	openedAt    time.Time
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int // probes in flight while half-open
+	successes   int // successful probes while half-open
+	generation  int // bumped on every state change
+	forgotten   bool
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*breaker
+}{m: make(map[string]*breaker)}
+
+// breakerFor returns the breaker for addr, configured by cfg.
+func breakerFor(addr string, cfg *CircuitBreaker) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	return breakerLocked(addr, cfg)
+}
+
+// breakerLocked is breakerFor with breakers locked.
+func breakerLocked(addr string, cfg *CircuitBreaker) *breaker {
+	b := breakers.m[addr]
+	if b == nil {
+		b = &breaker{addr: addr, windowStart: time.Now()}
+		breakers.m[addr] = b
+		breakerStates.Set(addr, stateVar(breakerClosed))
+	}
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+	return b
+}
+
+// retainBreakers counts backends among the users of the breakers of their
+// addresses, and releaseBreakers stops counting them. A breaker used by
+// no balancer backend anymore is forgotten, along with its metrics.
+func retainBreakers(backends []*Backend) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	for _, backend := range backends {
+		if backend.CircuitBreaker != nil {
+			breakerLocked(backend.Addr, backend.CircuitBreaker).refs++
+		}
+	}
+}
+
+func releaseBreakers(backends []*Backend) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	for _, backend := range backends {
+		b := breakers.m[backend.Addr]
+		if backend.CircuitBreaker == nil || b == nil {
+			continue
+		}
+		if b.refs--; b.refs <= 0 {
+			b.mu.Lock()
+			b.forgotten = true // by the metrics too, despite dials in flight
+			b.mu.Unlock()
+			delete(breakers.m, b.addr)
+			breakerStates.Delete(b.addr)
+			breakerTrips.Delete(b.addr)
+		}
+	}
+}
+
+// circuitOpen reports whether the breaker of Addr short-circuits dials.
+func (dialproxy *DialProxy) circuitOpen() bool {
+	if dialproxy.CircuitBreaker == nil {
+		return false
+	}
+	breakers.Lock()
+	b := breakers.m[dialproxy.Addr]
+	breakers.Unlock()
+	return b != nil && b.rejects()
+}
+
+func stateVar(state breakerState) *expvar.String {
+	v := new(expvar.String)
+	v.Set(state.String())
+	return v
+}
+
+// allow reports whether a dial may be attempted. Every allowed dial must
+// be followed by a call to done with the returned generation.
+func (b *breaker) allow(ctx context.Context) (generation int, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.openTimeout() {
+			return 0, false
+		}
+		b.setState(ctx, breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes+b.successes >= b.cfg.halfOpenProbes() {
+			return 0, false
+		}
+		b.probes++
+	}
+	return b.generation, true
+}
+
+// rejects reports whether allow would short-circuit a dial now.
+func (b *breaker) rejects() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) < b.cfg.openTimeout()
+	case breakerHalfOpen:
+		return b.probes+b.successes >= b.cfg.halfOpenProbes()
+	}
+	return false
+}
+
+// done records the outcome of a dial allowed in generation.
+func (b *breaker) done(ctx context.Context, generation int, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		// The dial was allowed before the last state change.
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probes--
+		if !ok {
+			b.trip(ctx)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.halfOpenProbes() {
+			b.setState(ctx, breakerClosed)
+		}
+		return
+	}
+
+	if now := time.Now(); now.Sub(b.windowStart) > b.cfg.window() {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if ok {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	cfg := b.cfg
+	if cfg.ConsecutiveFailures > 0 && b.consecutive >= cfg.ConsecutiveFailures {
+		b.trip(ctx)
+		return
+	}
+	if cfg.FailureRatio > 0 && b.requests >= cfg.minRequests() &&
+		float64(b.failures)/float64(b.requests) >= cfg.FailureRatio {
+		b.trip(ctx)
+	}
+}
+
+func (b *breaker) trip(ctx context.Context) {
+	b.openedAt = time.Now()
+	b.setState(ctx, breakerOpen)
+	if !b.forgotten {
+		breakerTrips.Add(b.addr, 1)
+	}
+}
+
+func (b *breaker) setState(ctx context.Context, state breakerState) {
+	if b.state == state {
+		return
+	}
+	log.WithContext(ctx).Warnf("circuit breaker for %s: %s -> %s", b.addr, b.state, state)
+
+	b.state = state
+	b.generation++
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.probes, b.successes = 0, 0
+	b.windowStart = time.Now()
+	if !b.forgotten {
+		breakerStates.Set(b.addr, stateVar(state))
+	}
+}
@@ -0,0 +1,293 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/log"
+)
+
+// CertStore holds the certificates of listeners terminating TLS and
+// picks one by SNI server name: an exact name first, then a wildcard
+// covering it ("*.example.com"), then the default certificate. The
+// certificates are loaded from files and PEM directories, and reloaded
+// by Reload or Watch when they change on disk.
+type CertStore struct {
+	mu          sync.Mutex
+	files       []certFile
+	dirs        []string
+	defaultFile *certFile
+
+	loaded    atomic.Value // *certSet of the last successful load
+	signature string       // of the files of the last load
+}
+
+type certFile struct {
+	cert, key string
+}
+
+// certSet is the certificates of one load of a CertStore.
+type certSet struct {
+	byName      map[string]*tls.Certificate // lower case, wildcards included
+	defaultCert *tls.Certificate
+}
+
+// NewCertStore returns an empty CertStore.
+func NewCertStore() *CertStore {
+	return &CertStore{}
+}
+
+// AddFile adds the certificate and key of the PEM files certPath and
+// keyPath, served for the names the certificate is valid for. Nothing is
+// added if they fail to load.
+func (store *CertStore) AddFile(certPath, keyPath string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	files := store.files
+	store.files = append(files[:len(files):len(files)], certFile{certPath, keyPath})
+	if err := store.reload(); err != nil {
+		store.files = files
+		return err
+	}
+	return nil
+}
+
+// AddDir adds the certificates of the PEM directory dir: every
+// "name.crt" or "name.pem" file with a "name.key" next to it, and every
+// ".pem" file holding both the certificate and its key. Nothing is added
+// if they fail to load.
+func (store *CertStore) AddDir(dir string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	dirs := store.dirs
+	store.dirs = append(dirs[:len(dirs):len(dirs)], dir)
+	if err := store.reload(); err != nil {
+		store.dirs = dirs
+		return err
+	}
+	return nil
+}
+
+// SetDefault sets the certificate served to clients sending no SNI or
+// one no other certificate matches.
+func (store *CertStore) SetDefault(certPath, keyPath string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	defaultFile := store.defaultFile
+	store.defaultFile = &certFile{certPath, keyPath}
+	if err := store.reload(); err != nil {
+		store.defaultFile = defaultFile
+		return err
+	}
+	return nil
+}
+
+// GetCertificate picks the certificate for hello. It is meant for
+// tls.Config.GetCertificate.
+func (store *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set, _ := store.loaded.Load().(*certSet)
+	if set == nil {
+		return nil, errors.New("no certificates loaded")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert := set.byName[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert := set.byName["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	if set.defaultCert != nil {
+		return set.defaultCert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// Reload loads all the certificates of store again. On error, the
+// certificates loaded before stay in use.
+func (store *CertStore) Reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.reload()
+}
+
+func (store *CertStore) reload() error {
+	files, err := store.allFiles()
+	if err != nil {
+		return err
+	}
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, f := range files {
+		cert, err := loadCert(f)
+		if err != nil {
+			return err
+		}
+		for _, name := range certNames(cert) {
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = cert
+			}
+		}
+	}
+	if store.defaultFile != nil {
+		if set.defaultCert, err = loadCert(*store.defaultFile); err != nil {
+			return err
+		}
+	}
+
+	store.loaded.Store(set)
+	store.signature = filesSignature(files, store.defaultFile)
+	return nil
+}
+
+// Watch reloads store every interval if its files changed, until ctx is
+// done.
+func (store *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	logger := log.WithContext(log.NewContext(ctx, log.Str("function", "certStore")))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		store.mu.Lock()
+		files, err := store.allFiles()
+		changed := err == nil && filesSignature(files, store.defaultFile) != store.signature
+		store.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := store.Reload(); err != nil {
+			logger.Errorf("reloading certificates: %v", err)
+			continue
+		}
+		logger.Info("certificates reloaded")
+	}
+}
+
+// allFiles lists the certificate files of store, directories expanded.
+func (store *CertStore) allFiles() ([]certFile, error) {
+	files := append([]certFile(nil), store.files...)
+	for _, dir := range store.dirs {
+		dirFiles, err := dirCertFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+func dirCertFiles(dir string) ([]certFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []certFile
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		cert := filepath.Join(dir, name)
+		key := strings.TrimSuffix(cert, ext) + ".key"
+		if _, err := os.Stat(key); err != nil {
+			if ext != ".pem" {
+				continue
+			}
+			// Key in the same file; PEM files without one, such as CA
+			// bundles, are no certificates to serve.
+			ok, err := hasPrivateKey(cert)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			key = cert
+		}
+		files = append(files, certFile{cert, key})
+	}
+	return files, nil
+}
+
+// hasPrivateKey reports whether the PEM file at path holds a private key.
+func hasPrivateKey(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return false, nil
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return true, nil
+		}
+	}
+}
+
+func loadCert(f certFile) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", f.cert, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("loading %s: %v", f.cert, err)
+	}
+	return &cert, nil
+}
+
+// certNames returns the lower case names cert is valid for.
+func certNames(cert *tls.Certificate) []string {
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	return lower
+}
+
+// filesSignature sums up the paths, sizes and modification times of the
+// certificate files, to tell when they change.
+func filesSignature(files []certFile, defaultFile *certFile) string {
+	if defaultFile != nil {
+		files = append(files, *defaultFile)
+	}
+	var b strings.Builder
+	for _, f := range files {
+		for _, path := range []string{f.cert, f.key} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(&b, "%s:missing;", path)
+				continue
+			}
+			fmt.Fprintf(&b, "%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
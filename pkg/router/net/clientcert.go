@@ -0,0 +1,171 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"strings"
+)
+
+// ClientCertMatcher reports whether a route accepts the verified client
+// certificate of a connection.
+type ClientCertMatcher func(ctx context.Context, cert *x509.Certificate) bool
+
+// AddClientCertRoute appends a route to the ipPort listener that routes
+// to dest if the client presented a certificate verified by the
+// listener's TLS configuration (see TerminateTLS) and accepted by
+// matcher.
+func (proxy *Proxy) AddClientCertRoute(ipPort string, matcher ClientCertMatcher, dest Target) {
+	proxy.addRoute(ipPort, ClientCertRoute(matcher, dest))
+}
+
+// ClientCertRoute returns the Route of AddClientCertRoute, for use with
+// SetRoute.
+func ClientCertRoute(matcher ClientCertMatcher, dest Target) Route {
+	return clientCertMatch{matcher, dest}
+}
+
+type clientCertMatch struct {
+	matcher ClientCertMatcher
+	target  Target
+}
+
+func (m clientCertMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	if cert := conn.ClientCert(); cert != nil && m.matcher(ctx, cert) {
+		return m.target
+	}
+	return nil
+}
+
+// ClientCert returns the client certificate of c if it was verified
+// while terminating TLS, or nil.
+func (c *Conn) ClientCert() *x509.Certificate {
+	if c.TLS == nil || len(c.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return c.TLS.VerifiedChains[0][0]
+}
+
+// SubjectMatcher accepts certificates whose subject common name is cn.
+func SubjectMatcher(cn string) ClientCertMatcher {
+	return func(ctx context.Context, cert *x509.Certificate) bool {
+		return cert.Subject.CommonName == cn
+	}
+}
+
+// SANMatcher accepts certificates with san among their DNS, email, IP or
+// URI subject alternative names. DNS names are compared like host names,
+// so san may be a wildcard like "*.example.com".
+func SANMatcher(san string) ClientCertMatcher {
+	hostMatcher := hostNameMatcher(san)
+	return func(ctx context.Context, cert *x509.Certificate) bool {
+		for _, name := range cert.DNSNames {
+			if hostMatcher(ctx, name) {
+				return true
+			}
+		}
+		for _, email := range cert.EmailAddresses {
+			if email == san {
+				return true
+			}
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == san {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if uri.String() == san {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SPIFFEIDMatcher accepts certificates with the SPIFFE ID id, like
+// "spiffe://example.org/billing". An id ending in "/*" accepts every ID
+// under that path, so "spiffe://example.org/*" accepts the whole trust
+// domain.
+func SPIFFEIDMatcher(id string) ClientCertMatcher {
+	return func(ctx context.Context, cert *x509.Certificate) bool {
+		got := SPIFFEID(cert)
+		if got == "" {
+			return false
+		}
+		if strings.HasSuffix(id, "/*") {
+			return strings.HasPrefix(got, id[:len(id)-1])
+		}
+		return got == id
+	}
+}
+
+// SPIFFEID returns the SPIFFE ID of cert, its spiffe:// URI subject
+// alternative name, or "".
+func SPIFFEID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// PROXY protocol v2 TLVs describing the terminated TLS connection.
+const (
+	proxyV2TypeSSL           = 0x20
+	proxyV2SubtypeSSLVersion = 0x21
+	proxyV2SubtypeSSLCN      = 0x22
+	proxyV2SubtypeSSLCipher  = 0x23
+
+	proxyV2ClientSSL      = 0x01
+	proxyV2ClientCertConn = 0x02
+
+	// proxyV2TypeSPIFFE carries the SPIFFE ID of the client certificate.
+	// The PROXY protocol reserves 0xE0 and up for custom uses.
+	proxyV2TypeSPIFFE = 0xE0
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// writeSSLTLVs writes the TLVs describing the TLS connection terminated
+// on conn, if any: PP2_TYPE_SSL, with the client certificate common name
+// if it was verified, and the SPIFFE ID of that certificate.
+func writeSSLTLVs(w *bytes.Buffer, conn *Conn) {
+	if conn.TLS == nil {
+		return
+	}
+	cert := conn.ClientCert()
+
+	var ssl bytes.Buffer
+	client := byte(proxyV2ClientSSL)
+	verify := uint32(1)
+	if cert != nil {
+		client |= proxyV2ClientCertConn
+		verify = 0
+	}
+	ssl.WriteByte(client)
+	binary.Write(&ssl, binary.BigEndian, verify)
+	if name, ok := tlsVersionNames[conn.TLS.Version]; ok {
+		writeTLV(&ssl, proxyV2SubtypeSSLVersion, []byte(name))
+	}
+	writeTLV(&ssl, proxyV2SubtypeSSLCipher, []byte(tls.CipherSuiteName(conn.TLS.CipherSuite)))
+	if cert != nil && cert.Subject.CommonName != "" {
+		writeTLV(&ssl, proxyV2SubtypeSSLCN, []byte(cert.Subject.CommonName))
+	}
+	writeTLV(w, proxyV2TypeSSL, ssl.Bytes())
+
+	if cert != nil {
+		if id := SPIFFEID(cert); id != "" {
+			writeTLV(w, proxyV2TypeSPIFFE, []byte(id))
+		}
+	}
+}
@@ -2,19 +2,54 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // DialProxy is target
 type DialProxy struct {
+	// Addr is the host:port to dial, or a unix socket path prefixed with
+	// "unix://". Abstract sockets are written "unix://@name".
 	Addr            string
 	KeepAlivePeriod time.Duration
 	DialTimeout     time.Duration
 	DialContext     func(ctx context.Context, network, address string) (net.Conn, error)
 	OnDialError     func(src net.Conn, dstDialErr error)
+
+	// ProxyProtocolVersion optionally specifies the version of the
+	// PROXY protocol header (ProxyProtocolV1 or ProxyProtocolV2) to send
+	// to Addr before any client bytes or TLS handshake. Zero sends no
+	// header.
+	ProxyProtocolVersion int
+
+	// CircuitBreaker optionally guards dials to Addr with a circuit
+	// breaker, failing them fast with ErrCircuitOpen while it is open.
+	CircuitBreaker *CircuitBreaker
+
+	// IdleTimeout optionally closes sessions in which no bytes went
+	// either way for that long.
+	IdleTimeout time.Duration
+	// MaxLifetime optionally closes sessions that long after they were
+	// established, active or not.
+	MaxLifetime time.Duration
+
+	// LingerTimeout bounds how long the other direction may keep going
+	// once one side of a session half-closed its connection. If zero, a
+	// default of 30 seconds is used.
+	LingerTimeout time.Duration
+
+	// TLSConfig optionally makes the connections to Addr use TLS. The
+	// handshake is part of the dial, bounded by DialTimeout. If
+	// TLSConfig.ServerName is empty, the host of Addr is used; unix socket
+	// addresses have none, so they need it set unless InsecureSkipVerify
+	// is.
+	TLSConfig *tls.Config
 }
 
 var defaultDialer = new(net.Dialer)
@@ -50,46 +85,268 @@ func goCloseConn(conn net.Conn) {
 // HandleConn ..
 func (dialproxy *DialProxy) HandleConn(ctx context.Context, src net.Conn) {
 
-	var cancel context.CancelFunc
+	dst, err := dialproxy.dial(ctx, src)
+	if err != nil {
+		dialproxy.onDialError()(src, err)
+		return
+	}
+
+	dialproxy.proxy(ctx, src, dst)
+}
+
+// dial connects to Addr for src, within DialTimeout.
+func (dialproxy *DialProxy) dial(ctx context.Context, src net.Conn) (net.Conn, error) {
+
+	if dialproxy.CircuitBreaker != nil {
+		breaker := breakerFor(dialproxy.Addr, dialproxy.CircuitBreaker)
+		generation, ok := breaker.allow(ctx)
+		if !ok {
+			return nil, ErrCircuitOpen
+		}
+		dst, err := dialproxy.dialAddr(ctx, src)
+		breaker.done(ctx, generation, err == nil)
+		return dst, err
+	}
+	return dialproxy.dialAddr(ctx, src)
+}
+
+func (dialproxy *DialProxy) dialAddr(ctx context.Context, src net.Conn) (net.Conn, error) {
+
 	if dialproxy.DialTimeout >= 0 {
+		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, dialproxy.dialTimeout())
+		defer cancel()
 	}
 
-	dst, err := dialproxy.dialContext()(ctx, "tcp", dialproxy.Addr)
-	if cancel != nil {
-		cancel()
+	network, address := splitNetwork(dialproxy.Addr)
+	dst, err := dialproxy.dialContext()(ctx, network, address)
+	if err != nil {
+		return nil, err
 	}
+	// Set on the TCP connection itself, before any TLS wraps it.
+	setKeepAlive(dst, dialproxy.keepAlivePeriod())
 
-	if err != nil {
-		dialproxy.onDialError()(src, err)
-		return
+	if err := dialproxy.startSession(ctx, src, dst); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	if dialproxy.TLSConfig == nil {
+		return dst, nil
+	}
+	return dialproxy.handshake(ctx, dst)
+}
+
+// startSession writes what Addr expects on dst before any TLS handshake
+// and the bytes of src: the PROXY protocol header, then the Postgres
+// SSLRequest src was accepted with, if TLS is passed through or
+// originated to Addr.
+func (dialproxy *DialProxy) startSession(ctx context.Context, src, dst net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		dst.SetDeadline(deadline)
+		defer dst.SetDeadline(time.Time{})
 	}
 
+	if dialproxy.ProxyProtocolVersion != 0 {
+		if err := writeProxyHeader(dst, dialproxy.ProxyProtocolVersion, src); err != nil {
+			return fmt.Errorf("writing PROXY header: %v", err)
+		}
+	}
+	if c, ok := src.(*Conn); ok && c.postgresSSL && (c.TLS == nil || dialproxy.TLSConfig != nil) {
+		if err := postgresStartTLS(dst); err != nil {
+			return fmt.Errorf("postgres SSLRequest: %v", err)
+		}
+	}
+	return nil
+}
+
+// handshake performs the client side TLS handshake on dst within ctx.
+func (dialproxy *DialProxy) handshake(ctx context.Context, dst net.Conn) (net.Conn, error) {
+	config := dialproxy.TLSConfig
+	if config.ServerName == "" {
+		name := tlsServerName(dialproxy.Addr)
+		if name == "" && !config.InsecureSkipVerify {
+			dst.Close()
+			return nil, fmt.Errorf("tls handshake: no ServerName to verify %s", dialproxy.Addr)
+		}
+		config = config.Clone()
+		config.ServerName = name
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		dst.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(dst, config)
+	if err := tlsConn.Handshake(); err != nil {
+		dst.Close()
+		return nil, fmt.Errorf("tls handshake: %v", err)
+	}
+	dst.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// tlsServerName returns the name the certificate of the server at addr
+// is verified for by default: the host of addr, or "" for unix sockets.
+func tlsServerName(addr string) string {
+	network, address := splitNetwork(addr)
+	if network == "unix" {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// unixScheme prefixes the addresses of unix sockets.
+const unixScheme = "unix://"
+
+// splitNetwork returns the network of addr, "unix" or "tcp", and the
+// address to dial or listen on.
+func splitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", addr[len(unixScheme):]
+	}
+	return "tcp", addr
+}
+
+// session sums up a proxied connection.
+type session struct {
+	// sent and received count the bytes from the client to the backend
+	// and back.
+	sent, received int64
+	// backendErr is the error reading from the backend ended with, if
+	// any.
+	backendErr error
+	// clientErr is the error reading from or writing to the client ended
+	// with, if any, and timedOut is set if the proxy closed the session
+	// on a timeout. Either way the session says nothing of the backend.
+	clientErr error
+	timedOut  bool
+}
+
+// proxy copies data between src and the dialed dst until either side is
+// done, then closes both.
+func (dialproxy *DialProxy) proxy(ctx context.Context, src, dst net.Conn) (s session) {
+
 	defer goCloseConn(dst)
 	defer goCloseConn(src)
 
-	if ka := dialproxy.keepAlivePeriod(); ka > 0 {
-		if c, ok := UnderlyingConn(src).(*net.TCPConn); ok {
-			c.SetKeepAlive(true)
-			c.SetKeepAlivePeriod(ka)
+	setKeepAlive(src, dialproxy.keepAlivePeriod())
+
+	var activity *int64
+	var expired int32 // set by watchSession, accessed atomically
+	if dialproxy.IdleTimeout > 0 || dialproxy.MaxLifetime > 0 {
+		activity = new(int64)
+		done := make(chan struct{})
+		defer close(done)
+		go dialproxy.watchSession(done, src, dst, activity, &expired)
+	}
+	defer func() {
+		if atomic.LoadInt32(&expired) != 0 {
+			s.timedOut = true
+		}
+	}()
+
+	// The read errors of each direction tell the failures of one side
+	// from those of the other; only the errors of the directions done
+	// before the proxy closed both sides are recorded.
+	var backendReadErr, clientReadErr error
+	fromBackend := make(chan error, 1)
+	toBackend := make(chan error, 1)
+	go proxyCopy(fromBackend, src, dst, &s.received, &backendReadErr, activity)
+	go proxyCopy(toBackend, dst, src, &s.sent, &clientReadErr, activity)
+
+	record := func(fromBackendDone bool, err error) {
+		switch {
+		case fromBackendDone && backendReadErr != nil:
+			s.backendErr = backendReadErr
+		case fromBackendDone && err != nil:
+			s.clientErr = err
+		case !fromBackendDone && clientReadErr != nil:
+			s.clientErr = clientReadErr
+		}
+	}
+
+	// Once a direction hits EOF, pass the half-close on and let the
+	// other one finish, within LingerTimeout. Otherwise close both sides.
+	// Either way, wait for both directions so the byte counts are final.
+	var err error
+	var other <-chan error
+	var otherIsBackend bool
+	select {
+	case err = <-fromBackend:
+		record(true, err)
+		if err == nil {
+			err = closeWrite(src)
 		}
-		if c, ok := dst.(*net.TCPConn); ok {
-			c.SetKeepAlive(true)
-			c.SetKeepAlivePeriod(ka)
+		other, otherIsBackend = toBackend, false
+	case err = <-toBackend:
+		record(false, err)
+		if err == nil {
+			err = closeWrite(dst)
 		}
+		other, otherIsBackend = fromBackend, true
 	}
 
-	errc := make(chan error, 1)
-	go proxyCopy(errc, src, dst)
-	go proxyCopy(errc, dst, src)
+	if err == nil {
+		linger := time.NewTimer(dialproxy.lingerTimeout())
+		defer linger.Stop()
+		select {
+		case err = <-other:
+			record(otherIsBackend, err)
+			return s
+		case <-linger.C:
+			s.timedOut = true
+		}
+	}
+
+	goCloseConn(src)
+	goCloseConn(dst)
+	<-other
+	return s
+}
+
+// setKeepAlive enables TCP keep-alives with period on conn, if it is a
+// TCP connection and period is positive.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if c, ok := UnderlyingConn(conn).(*net.TCPConn); ok && period > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(period)
+	}
+}
 
-	<-errc
+// closeWriter is implemented by connections that can be half-closed,
+// such as *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
 }
 
-func proxyCopy(errc chan<- error, dst, src net.Conn) {
+// closeWrite shuts down the writing side of conn, or reports an error if
+// conn can't be half-closed.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := UnderlyingConn(conn).(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+func (dialproxy *DialProxy) lingerTimeout() time.Duration {
+	if dialproxy.LingerTimeout > 0 {
+		return dialproxy.LingerTimeout
+	}
+	return 30 * time.Second
+}
+
+// proxyCopy copies from src to dst, adding the bytes copied to written.
+// The error reading src ended with, if any, is stored in readErr before
+// the error of the copy is sent on errc. If activity is not nil, the
+// time of every read is stored in it.
+func proxyCopy(errc chan<- error, dst, src net.Conn, written *int64, readErr *error, activity *int64) {
 
 	if srcconn, ok := src.(*Conn); ok && len(srcconn.Peeked) > 0 {
-		if _, err := dst.Write(srcconn.Peeked); err != nil {
+		n, err := dst.Write(srcconn.Peeked)
+		*written += int64(n)
+		if err != nil {
 			errc <- err
 			return
 		}
@@ -98,11 +355,31 @@ func proxyCopy(errc chan<- error, dst, src net.Conn) {
 
 	src = UnderlyingConn(src)
 	dst = UnderlyingConn(dst)
+	if activity != nil {
+		src = activityConn{src, activity}
+	}
 
-	_, err := io.Copy(dst, src)
+	reader := &errReader{Reader: src}
+	n, err := io.Copy(dst, reader)
+	*written += n
+	*readErr = reader.err
 	errc <- err
 }
 
+// errReader is an io.Reader keeping the error of Reader other than EOF.
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
 func (dialproxy *DialProxy) dialTimeout() time.Duration {
 	if dialproxy.DialTimeout > 0 {
 		return dialproxy.DialTimeout
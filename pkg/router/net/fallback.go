@@ -0,0 +1,100 @@
+package http
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// unmatchedConns counts the connections no route matched, fallback or
+// not, by listener.
+var unmatchedConns = expvar.NewMap("unmatched_connections")
+
+// SetFallback makes the ipPort listener hand the connections no route
+// matches to dest, instead of closing them: another backend, a Sink or a
+// Respond. A nil dest closes them again. It is safe to call on a running
+// Proxy.
+func (proxy *Proxy) SetFallback(ipPort string, dest Target) {
+	proxy.configFor(ipPort).fallback.Store(fallbackTarget{dest})
+}
+
+// fallbackTarget wraps the fallback of a listener, which may be nil, for
+// storage in an atomic.Value.
+type fallbackTarget struct {
+	Target
+}
+
+func (cfg *routerConfig) loadFallback() Target {
+	fallback, _ := cfg.fallback.Load().(fallbackTarget)
+	return fallback.Target
+}
+
+// Sink is a Target reading and discarding everything clients send, like
+// a honeypot, until they close the connection or Timeout expires.
+type Sink struct {
+	// Timeout optionally bounds the time connections are held.
+	Timeout time.Duration
+}
+
+// HandleConn ..
+func (sink Sink) HandleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if sink.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(sink.Timeout))
+	}
+	io.Copy(ioutil.Discard, conn)
+}
+
+// Respond is a Target answering clients with a canned Payload, like an
+// HTTP error page or a TLS alert, then closing their connection.
+type Respond struct {
+	Payload []byte
+}
+
+// respondLinger bounds how long Respond drains what clients still send
+// after the payload, so that closing doesn't reset the connection before
+// they read it.
+const respondLinger = time.Second
+
+// HandleConn ..
+func (respond Respond) HandleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(respondLinger))
+	if _, err := conn.Write(respond.Payload); err != nil {
+		return
+	}
+	closeWrite(conn)
+	io.Copy(ioutil.Discard, conn)
+}
+
+// HTTPErrorResponse returns an HTTP/1.1 response with the status code,
+// like 421 (Misdirected Request) or 502 (Bad Gateway), for Respond.
+func HTTPErrorResponse(code int) []byte {
+	body := fmt.Sprintf("%d %s\n", code, http.StatusText(code))
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n"+
+		"\r\n%s", code, http.StatusText(code), len(body), body))
+}
+
+// TLS alert descriptions for TLSAlert.
+const (
+	TLSAlertHandshakeFailure = 40
+	TLSAlertUnrecognizedName = 112
+)
+
+// TLSAlert returns a fatal TLS alert record with the description, for
+// Respond to fail the handshake of TLS clients.
+func TLSAlert(description byte) []byte {
+	const (
+		recordTypeAlert = 0x15
+		alertLevelFatal = 2
+	)
+	return []byte{recordTypeAlert, 0x03, 0x01, 0, 2, alertLevelFatal, description}
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Session affinity strategies of a Balancer. Clients are mapped to a
+// backend on a consistent-hash ring, so adding or removing a backend
+// only remaps the clients of that backend. A backend already carrying
+// more than its fair share of connections (with some slack) is skipped
+// for the next one on the ring.
+const (
+	// SourceIPHash maps clients by their source IP.
+	SourceIPHash = "source-ip-hash"
+	// SNIHash maps clients by the hostname they asked for (the TLS SNI
+	// or HTTP Host), falling back to their source IP.
+	SNIHash = "sni-hash"
+)
+
+const (
+	// ringReplicas is the number of points each unit of backend weight
+	// gets on the ring.
+	ringReplicas = 100
+	// hashLoadFactor bounds a backend's connections to this factor of the
+	// average before its clients spill over to the next backend.
+	hashLoadFactor = 1.25
+)
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+type consistentHash struct {
+	key func(net.Conn) string
+
+	mu   sync.Mutex
+	ring []ringPoint // of all the balancer's backends
+}
+
+func sourceIPKey(src net.Conn) string {
+	addr := src.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func sniKey(src net.Conn) string {
+	if conn, ok := src.(*Conn); ok && conn.HostName != "" {
+		return conn.HostName
+	}
+	return sourceIPKey(src)
+}
+
+// setBackends builds the ring of all the backends of the balancer, so
+// that a client keeps its backend while others are unavailable.
+func (s *consistentHash) setBackends(backends []*Backend) {
+	ring := buildRing(backends)
+	s.mu.Lock()
+	s.ring = ring
+	s.mu.Unlock()
+}
+
+// pick walks the ring clockwise from the client's hash, skipping the
+// backends not in backends.
+func (s *consistentHash) pick(src net.Conn, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	ring := s.ring
+	s.mu.Unlock()
+
+	candidates := make(map[*Backend]bool, len(backends))
+	var total int64
+	for _, backend := range backends {
+		candidates[backend] = true
+		total += backend.Conns()
+	}
+	// The bounded-load capacity per unit of weight, counting the new
+	// connection.
+	capacity := hashLoadFactor * float64(total+1) / float64(totalWeight(backends))
+
+	h := hashKey(s.key(src))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	var first *Backend
+	for i := 0; i < len(ring); i++ {
+		backend := ring[(start+i)%len(ring)].backend
+		if !candidates[backend] {
+			continue
+		}
+		if first == nil {
+			first = backend
+		}
+		if float64(backend.Conns()) < math.Ceil(capacity*float64(backend.weight())) {
+			return backend
+		}
+	}
+	if first == nil {
+		// Not on the ring yet.
+		return backends[0]
+	}
+	return first
+}
+
+func buildRing(backends []*Backend) []ringPoint {
+	var ring []ringPoint
+	for _, backend := range backends {
+		for i := 0; i < ringReplicas*backend.weight(); i++ {
+			ring = append(ring, ringPoint{hashKey(backend.Addr + "#" + strconv.Itoa(i)), backend})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func totalWeight(backends []*Backend) int {
+	total := 0
+	for _, backend := range backends {
+		total += backend.weight()
+	}
+	return total
+}
+
+// hashKey is FNV-1a followed by a 64 bit finalizer, as FNV alone spreads
+// similar keys (like "addr#1", "addr#2") poorly.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,235 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/log"
+)
+
+// HealthCheck configures the active health checks of a Balancer's
+// backends. Unhealthy backends get no new connections until they
+// recover.
+type HealthCheck struct {
+	// Interval is the delay between two checks of a backend.
+	Interval time.Duration
+	// Timeout bounds a whole check: connecting, the TLS handshake and
+	// the Send/Expect exchange.
+	Timeout time.Duration
+	// Rise is the number of consecutive successful checks marking an
+	// unhealthy backend healthy, and Fall the number of consecutive failed
+	// ones marking a healthy backend unhealthy. The first check sets the
+	// initial state on its own.
+	Rise int
+	Fall int
+	// Send is optionally written once connected, and Expect must then be
+	// read back, if set.
+	Send   []byte
+	Expect []byte
+	// TLS makes the check perform a TLS handshake, verifying the server
+	// certificate for ServerName, the host of the backend address by
+	// default, unless InsecureSkipVerify is set. Backends dialed with a
+	// TLSConfig are always checked over TLS, starting from that config.
+	// Backends expecting a PROXY protocol header get one announcing no
+	// client first.
+	TLS                bool
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval > 0 {
+		return hc.Interval
+	}
+	return 10 * time.Second
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.Timeout > 0 {
+		return hc.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (hc *HealthCheck) rise() int {
+	if hc.Rise > 0 {
+		return hc.Rise
+	}
+	return 2
+}
+
+func (hc *HealthCheck) fall() int {
+	if hc.Fall > 0 {
+		return hc.Fall
+	}
+	return 3
+}
+
+// Healthy reports whether backend passes its health checks.
+func (backend *Backend) Healthy() bool {
+	return atomic.LoadInt32(&backend.unhealthy) == 0
+}
+
+// StartHealthChecks starts checking the backends of balancer as
+// configured by its HealthCheck, until ctx is done. Backends later added
+// by SetBackends are checked too.
+func (balancer *Balancer) StartHealthChecks(ctx context.Context) {
+	if balancer.HealthCheck == nil {
+		return
+	}
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+
+	balancer.checks.ctx = ctx
+	balancer.checks.sync(balancer.HealthCheck, balancer.backends)
+}
+
+// healthChecks tracks the health check goroutine of every backend of a
+// Balancer, once started.
+type healthChecks struct {
+	ctx     context.Context // nil until StartHealthChecks
+	cancels map[*Backend]context.CancelFunc
+}
+
+// sync starts checking the backends not checked yet and stops checking
+// the ones no longer in backends.
+func (checks *healthChecks) sync(hc *HealthCheck, backends []*Backend) {
+	if hc == nil || checks.ctx == nil {
+		return
+	}
+	if checks.cancels == nil {
+		checks.cancels = make(map[*Backend]context.CancelFunc)
+	}
+
+	keep := make(map[*Backend]bool, len(backends))
+	for _, backend := range backends {
+		keep[backend] = true
+		if _, ok := checks.cancels[backend]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(checks.ctx)
+		checks.cancels[backend] = cancel
+		go hc.run(ctx, backend)
+	}
+	for backend, cancel := range checks.cancels {
+		if !keep[backend] {
+			cancel()
+			delete(checks.cancels, backend)
+		}
+	}
+}
+
+func (hc *HealthCheck) run(ctx context.Context, backend *Backend) {
+	ctxLog := log.NewContext(ctx, log.Str("function", "healthCheck"), log.Str("backend", backend.Addr))
+	logger := log.WithContext(ctxLog)
+
+	ticker := time.NewTicker(hc.interval())
+	defer ticker.Stop()
+
+	var successes, failures int
+	first := true
+	for {
+		err := hc.check(ctx, backend.DialProxy)
+		if err == nil {
+			successes, failures = successes+1, 0
+		} else {
+			successes, failures = 0, failures+1
+		}
+
+		switch healthy := backend.Healthy(); {
+		case err != nil && (first || healthy && failures >= hc.fall()):
+			atomic.StoreInt32(&backend.unhealthy, 1)
+			logger.Warnf("backend %s is down: %v", backend.Addr, err)
+		case err == nil && !healthy && (first || successes >= hc.rise()):
+			atomic.StoreInt32(&backend.unhealthy, 0)
+			logger.Infof("backend %s is up", backend.Addr)
+		}
+		first = false
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var errUnexpectedResponse = errors.New("unexpected health check response")
+
+// tlsConfig returns the TLS config checking the backend of dialproxy.
+func (hc *HealthCheck) tlsConfig(dialproxy *DialProxy) *tls.Config {
+	config := &tls.Config{}
+	if dialproxy.TLSConfig != nil {
+		config = dialproxy.TLSConfig.Clone()
+	}
+	if hc.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	if hc.ServerName != "" {
+		config.ServerName = hc.ServerName
+	}
+	if config.ServerName == "" {
+		config.ServerName = tlsServerName(dialproxy.Addr)
+	}
+	return config
+}
+
+// check performs a single health check of dialproxy's address.
+func (hc *HealthCheck) check(ctx context.Context, dialproxy *DialProxy) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout())
+	defer cancel()
+
+	network, address := splitNetwork(dialproxy.Addr)
+	conn, err := dialproxy.dialContext()(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if dialproxy.ProxyProtocolVersion != 0 {
+		if err := writeLocalProxyHeader(conn, dialproxy.ProxyProtocolVersion); err != nil {
+			return fmt.Errorf("writing PROXY header: %v", err)
+		}
+	}
+
+	if hc.TLS || dialproxy.TLSConfig != nil {
+		tlsConn := tls.Client(conn, hc.tlsConfig(dialproxy))
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("tls handshake: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	if len(hc.Send) > 0 {
+		if _, err := conn.Write(hc.Send); err != nil {
+			return err
+		}
+	}
+	if len(hc.Expect) == 0 {
+		return nil
+	}
+
+	// Expect must show up within the first 64KB read.
+	const maxResponse = 64 << 10
+	var got []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if bytes.Contains(got, hc.Expect) {
+			return nil
+		}
+		if err != nil || len(got) > maxResponse {
+			return errUnexpectedResponse
+		}
+	}
+}
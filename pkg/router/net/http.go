@@ -0,0 +1,98 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+)
+
+// AddHTTPHostRoute appends a route to the ipPort listener that routes to
+// dest if the incoming HTTP/1.x Host header is httpHost. httpHost may be
+// a wildcard like "*.example.com". Any port in the Host header is ignored.
+//
+// The request is not modified; the peeked bytes are replayed to dest.
+func (proxy *Proxy) AddHTTPHostRoute(ipPort, httpHost string, dest Target) {
+	proxy.addRoute(ipPort, HTTPHostRoute(httpHost, dest))
+}
+
+// AddHTTPHostMatchRoute appends a route to the ipPort listener that routes
+// to dest if the incoming HTTP/1.x Host header is accepted by matcher.
+func (proxy *Proxy) AddHTTPHostMatchRoute(ipPort string, matcher Matcher, dest Target) {
+	proxy.addRoute(ipPort, HTTPHostMatchRoute(matcher, dest))
+}
+
+// HTTPHostRoute returns the Route of AddHTTPHostRoute, for use with
+// SetRoute.
+func HTTPHostRoute(httpHost string, dest Target) Route {
+	return httpHostMatch{hostNameMatcher(httpHost), dest}
+}
+
+// HTTPHostMatchRoute returns the Route of AddHTTPHostMatchRoute, for use
+// with SetRoute.
+func HTTPHostMatchRoute(matcher Matcher, dest Target) Route {
+	return httpHostMatch{matcher, dest}
+}
+
+type httpHostMatch struct {
+	matcher Matcher
+	target  Target
+}
+
+func (m httpHostMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	host := httpHostHeader(br)
+	if host == "" {
+		return nil
+	}
+	conn.HostName = host
+	if m.matcher(ctx, host) {
+		return m.target
+	}
+	return nil
+}
+
+var (
+	crlfcrlf = []byte("\r\n\r\n")
+	lflf     = []byte("\n\n")
+)
+
+// httpHostHeader peeks the HTTP/1.x request line and headers from br
+// without consuming them and returns the Host header with any port
+// removed. It returns "" if the buffered bytes are not an HTTP/1.x request
+// or its headers don't fit in br's buffer.
+func httpHostHeader(br *bufio.Reader) string {
+	for peekSize := 1; peekSize <= br.Size(); peekSize++ {
+		b, err := br.Peek(peekSize)
+		if n := br.Buffered(); n > peekSize {
+			b, _ = br.Peek(n)
+			peekSize = n
+		}
+		if len(b) > 0 && (b[0] < 'A' || b[0] > 'Z') {
+			// Request methods are upper case tokens.
+			return ""
+		}
+		if bytes.Contains(b, crlfcrlf) || bytes.Contains(b, lflf) {
+			return httpHostFromRequest(b)
+		}
+		if err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+func httpHostFromRequest(b []byte) string {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil || req.ProtoMajor != 1 {
+		return ""
+	}
+	if len(req.Header["Host"]) > 1 {
+		// Ambiguous; refuse to route on it.
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
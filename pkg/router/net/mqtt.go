@@ -0,0 +1,185 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// MQTTConnect holds the fields of an MQTT CONNECT packet routes match on.
+type MQTTConnect struct {
+	// ProtocolLevel is 3 for MQTT 3.1, 4 for MQTT 3.1.1 and 5 for MQTT 5.
+	ProtocolLevel byte
+	ClientID      string
+	// Username is empty if the client sent none.
+	Username string
+}
+
+// MQTTMatcher reports whether a route accepts an MQTT client.
+type MQTTMatcher func(ctx context.Context, connect *MQTTConnect) bool
+
+// AddMQTTRoute appends a route to the ipPort listener that routes to
+// dest if the incoming MQTT CONNECT packet is accepted by matcher. The
+// packet must fit in the peek buffer (16KB).
+//
+// The packet is not modified; the peeked bytes are replayed to dest.
+func (proxy *Proxy) AddMQTTRoute(ipPort string, matcher MQTTMatcher, dest Target) {
+	proxy.addRoute(ipPort, MQTTRoute(matcher, dest))
+}
+
+// MQTTRoute returns the Route of AddMQTTRoute, for use with SetRoute.
+func MQTTRoute(matcher MQTTMatcher, dest Target) Route {
+	return mqttMatch{matcher, dest}
+}
+
+type mqttMatch struct {
+	matcher MQTTMatcher
+	target  Target
+}
+
+func (m mqttMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	connect := mqttConnect(br)
+	if connect == nil {
+		return nil
+	}
+	if m.matcher(ctx, connect) {
+		return m.target
+	}
+	return nil
+}
+
+// mqttConnect peeks the MQTT CONNECT packet from br without consuming it.
+// It returns nil if the buffered bytes are not a CONNECT packet or it
+// doesn't fit in br's buffer.
+func mqttConnect(br *bufio.Reader) *MQTTConnect {
+	const packetTypeConnect = 0x10
+	if !peekPrefix(br, []byte{packetTypeConnect}) {
+		return nil
+	}
+
+	// The remaining length is a variable byte integer of up to 4 bytes.
+	remaining, shift := 0, uint(0)
+	headerLen := 1
+	for {
+		b, err := br.Peek(headerLen + 1)
+		if err != nil {
+			return nil
+		}
+		digit := b[headerLen]
+		headerLen++
+		remaining |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return nil
+		}
+	}
+	if headerLen+remaining > br.Size() {
+		return nil
+	}
+	packet, err := br.Peek(headerLen + remaining)
+	if err != nil {
+		return nil
+	}
+
+	connect, err := parseMQTTConnect(packet[headerLen:])
+	if err != nil {
+		return nil
+	}
+	return connect
+}
+
+var errMQTTMalformed = errors.New("malformed MQTT CONNECT packet")
+
+// CONNECT flags.
+const (
+	mqttFlagWill     = 0x04
+	mqttFlagUsername = 0x80
+)
+
+// parseMQTTConnect parses the variable header and payload of a CONNECT
+// packet, up to the username.
+func parseMQTTConnect(b []byte) (*MQTTConnect, error) {
+	r := mqttReader{b: b}
+	switch name := r.readString(); name {
+	case "MQTT", "MQIsdp":
+	default:
+		return nil, errMQTTMalformed
+	}
+	connect := &MQTTConnect{ProtocolLevel: r.readByte()}
+	flags := r.readByte()
+	r.skip(2) // keep alive
+	if connect.ProtocolLevel >= 5 {
+		r.skip(r.readVarint()) // properties
+	}
+
+	connect.ClientID = r.readString()
+	if flags&mqttFlagWill != 0 {
+		if connect.ProtocolLevel >= 5 {
+			r.skip(r.readVarint()) // will properties
+		}
+		r.readString() // will topic
+		r.readString() // will payload
+	}
+	if flags&mqttFlagUsername != 0 {
+		connect.Username = r.readString()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return connect, nil
+}
+
+// mqttReader reads the fields of an MQTT packet from b, recording the
+// first error.
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errMQTTMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *mqttReader) skip(n int) { r.next(n) }
+
+func (r *mqttReader) readByte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// readString reads a length prefixed UTF-8 string or binary data.
+func (r *mqttReader) readString() string {
+	n := r.next(2)
+	if n == nil {
+		return ""
+	}
+	return string(r.next(int(binary.BigEndian.Uint16(n))))
+}
+
+// readVarint reads a variable byte integer.
+func (r *mqttReader) readVarint() int {
+	v := 0
+	for shift := uint(0); shift <= 21; shift += 7 {
+		digit := r.readByte()
+		if r.err != nil {
+			return 0
+		}
+		v |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			return v
+		}
+	}
+	r.err = errMQTTMalformed
+	return 0
+}
@@ -0,0 +1,147 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/anabiozz/rproxy/pkg/log"
+)
+
+// OutlierDetection configures the passive health checking of a
+// Balancer: backends failing sessions are ejected from rotation for a
+// while, for longer each time they are ejected again.
+//
+// A session fails when the backend can't be dialed, resets the
+// connection, or closes it without sending a byte although the client
+// sent some. Sessions ended by the client, or closed by the proxy on a
+// timeout, don't count.
+type OutlierDetection struct {
+	// ConsecutiveFailures ejects a backend after this many failed
+	// sessions in a row.
+	ConsecutiveFailures int
+	// BaseEjectionTime is how long the first ejection lasts; it doubles
+	// with each following ejection, up to MaxEjectionTime. A backend not
+	// ejected for MaxEjectionTime starts over from BaseEjectionTime.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent caps the share of a balancer's backends ejected
+	// at once. At least one backend may always be ejected.
+	MaxEjectionPercent int
+}
+
+func (od *OutlierDetection) consecutiveFailures() int {
+	if od.ConsecutiveFailures > 0 {
+		return od.ConsecutiveFailures
+	}
+	return 5
+}
+
+func (od *OutlierDetection) baseEjectionTime() time.Duration {
+	if od.BaseEjectionTime > 0 {
+		return od.BaseEjectionTime
+	}
+	return 30 * time.Second
+}
+
+func (od *OutlierDetection) maxEjectionTime() time.Duration {
+	if od.MaxEjectionTime > 0 {
+		return od.MaxEjectionTime
+	}
+	return 5 * time.Minute
+}
+
+func (od *OutlierDetection) maxEjected(backends int) int {
+	percent := od.MaxEjectionPercent
+	if percent <= 0 {
+		percent = 50
+	}
+	if n := backends * percent / 100; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// outlierEjections counts the ejections of every backend by address.
+var outlierEjections = expvar.NewMap("outlier_ejections")
+
+// outlierState is the passive health of a backend, guarded by the
+// balancer's outlierMu.
+type outlierState struct {
+	failures     int       // consecutive failed sessions
+	ejections    int       // ejections since the backend was last healthy for long
+	ejectedUntil int64     // unix nanoseconds, accessed atomically
+	lastEjected  time.Time // end of the last ejection
+}
+
+// Ejected reports whether backend is ejected from rotation by outlier
+// detection.
+func (backend *Backend) Ejected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&backend.outlier.ejectedUntil)
+}
+
+// failedSession reports whether s looks like a failure of the backend.
+// Sessions the client or a proxy timeout ended are not.
+func failedSession(s session) bool {
+	if s.clientErr != nil || s.timedOut {
+		return false
+	}
+	if errors.Is(s.backendErr, syscall.ECONNRESET) {
+		return true
+	}
+	return s.received == 0 && s.sent > 0
+}
+
+// report feeds the outcome of a session with backend to the outlier
+// detection of balancer.
+func (balancer *Balancer) report(ctx context.Context, backend *Backend, failed bool) {
+	od := balancer.OutlierDetection
+	if od == nil {
+		return
+	}
+
+	balancer.outlierMu.Lock()
+	defer balancer.outlierMu.Unlock()
+
+	state := &backend.outlier
+	if !failed {
+		state.failures = 0
+		return
+	}
+	state.failures++
+	if state.failures < od.consecutiveFailures() || backend.Ejected() {
+		return
+	}
+
+	backends := balancer.Backends()
+	ejected := 0
+	for _, b := range backends {
+		if b.Ejected() {
+			ejected++
+		}
+	}
+	if ejected >= od.maxEjected(len(backends)) {
+		return
+	}
+
+	now := time.Now()
+	if !state.lastEjected.IsZero() && now.Sub(state.lastEjected) > od.maxEjectionTime() {
+		state.ejections = 0
+	}
+	ejection := od.maxEjectionTime()
+	if state.ejections < 32 {
+		if d := od.baseEjectionTime() << uint(state.ejections); d > 0 && d < ejection {
+			ejection = d
+		}
+	}
+	state.ejections++
+	state.failures = 0
+	state.lastEjected = now.Add(ejection)
+	atomic.StoreInt64(&state.ejectedUntil, state.lastEjected.UnixNano())
+
+	outlierEjections.Add(backend.Addr, 1)
+	log.WithContext(ctx).Warnf("backend %s ejected for %v after failed sessions", backend.Addr, ejection)
+}
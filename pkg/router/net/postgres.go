@@ -0,0 +1,105 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// postgresSSLRequest is the message Postgres clients send to ask for TLS
+// before their ClientHello: its length and the SSLRequest code 80877103.
+var postgresSSLRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// AddPostgresSNIRoute appends a route to the ipPort listener that routes
+// Postgres connections to dest if their TLS SNI server name is sni, so
+// many databases can be served on one port. sni may be a wildcard like
+// "*.example.com". Clients must connect with TLS (sslmode=require or
+// stricter) and send SNI, which libpq does from version 14.
+//
+// The SSLRequest of the client is answered by the proxy and replayed to
+// dest along with the ClientHello, so TLS is still terminated by the
+// database. On listeners terminating TLS (see TerminateTLS), the proxy
+// terminates it instead and the plaintext is forwarded, unless the
+// DialProxy of dest originates TLS to the database again.
+func (proxy *Proxy) AddPostgresSNIRoute(ipPort, sni string, dest Target) {
+	proxy.addRoute(ipPort, PostgresSNIRoute(sni, dest))
+}
+
+// PostgresSNIRoute returns the Route of AddPostgresSNIRoute, for use with
+// SetRoute.
+func PostgresSNIRoute(sni string, dest Target) Route {
+	return postgresMatch{hostNameMatcher(sni), dest}
+}
+
+// hasPostgresRoutes reports whether routes include Postgres routes.
+func hasPostgresRoutes(routes []namedRoute) bool {
+	for _, route := range routes {
+		if _, ok := route.Route.(postgresMatch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type postgresMatch struct {
+	matcher Matcher
+	target  Target
+}
+
+func (m postgresMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	if !acceptPostgresSSLRequest(conn, br) {
+		return nil
+	}
+	if conn.TLS != nil {
+		if m.matcher(ctx, conn.TLS.ServerName) {
+			return m.target
+		}
+		return nil
+	}
+	hello := clientHello(br)
+	if hello == nil {
+		return nil
+	}
+	conn.HostName = hello.ServerName
+	conn.ALPN = hello.SupportedProtos
+	if m.matcher(ctx, hello.ServerName) {
+		return m.target
+	}
+	return nil
+}
+
+// acceptPostgresSSLRequest reports whether conn opened with a Postgres
+// SSLRequest. The first time, the SSLRequest is consumed from br and
+// accepted, so that the client goes on with its TLS handshake.
+func acceptPostgresSSLRequest(conn *Conn, br *bufio.Reader) bool {
+	if conn.postgresSSL {
+		return true
+	}
+	if conn.TLS != nil || !peekPrefix(br, postgresSSLRequest) {
+		return false
+	}
+	if _, err := conn.Conn.Write([]byte{'S'}); err != nil {
+		return false
+	}
+	br.Discard(len(postgresSSLRequest))
+	conn.postgresSSL = true
+	return true
+}
+
+// postgresStartTLS sends an SSLRequest to the Postgres server on dst and
+// checks that it is willing to go on with TLS.
+func postgresStartTLS(dst net.Conn) error {
+	if _, err := dst.Write(postgresSSLRequest); err != nil {
+		return err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(dst, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 'S' {
+		return fmt.Errorf("server refused TLS (%q)", reply[0])
+	}
+	return nil
+}
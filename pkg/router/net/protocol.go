@@ -0,0 +1,100 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"time"
+)
+
+// Protocol identifies a protocol by the first bytes its clients send: a
+// connection speaks it if its data starts with any of the prefixes.
+type Protocol [][]byte
+
+// Protocols detected by AddProtocolRoute. Custom ones are built from
+// their own prefixes, like Protocol{[]byte("\x00\x00\x00\x08\x04\xd2\x16\x2f")}.
+var (
+	// ProtocolTLS matches a TLS handshake record.
+	ProtocolTLS = Protocol{{0x16, 0x03}}
+	// ProtocolHTTP matches HTTP/1.x requests and the HTTP/2 cleartext
+	// connection preface.
+	ProtocolHTTP = Protocol{
+		[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+		[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "),
+		[]byte("CONNECT "), []byte("TRACE "), []byte("PRI * HTTP/2.0"),
+	}
+	// ProtocolSSH matches the version banner of SSH clients.
+	ProtocolSSH = Protocol{[]byte("SSH-")}
+	// ProtocolPROXY matches PROXY protocol v1 and v2 headers, for
+	// listeners passing them on to servers rather than reading them (see
+	// AcceptProxyProtocol).
+	ProtocolPROXY = Protocol{[]byte("PROXY "), proxyV2Signature}
+)
+
+// AddProtocolRoute appends a route to the ipPort listener that routes to
+// dest if the connection speaks proto, to serve several protocols on one
+// port like sslh. Routes are tried in order on the bytes received so far,
+// waiting for more only while they could still match; a route added by
+// AddRoute last is the fallback for the other protocols. Clients of
+// protocols where the server speaks first reach the fallback once the
+// peek timeout (see SetPeekTimeout) expires, after 2 seconds on listeners
+// without one.
+//
+// The peeked bytes are replayed to dest.
+func (proxy *Proxy) AddProtocolRoute(ipPort string, proto Protocol, dest Target) {
+	proxy.addRoute(ipPort, ProtocolRoute(proto, dest))
+}
+
+// ProtocolRoute returns the Route of AddProtocolRoute, for use with
+// SetRoute.
+func ProtocolRoute(proto Protocol, dest Target) Route {
+	return protocolMatch{proto, dest}
+}
+
+// protocolPeekTimeout is the peek timeout of listeners with protocol
+// routes and none set.
+var protocolPeekTimeout = 2 * time.Second
+
+// hasProtocolRoutes reports whether routes include protocol routes.
+func hasProtocolRoutes(routes []namedRoute) bool {
+	for _, route := range routes {
+		if _, ok := route.Route.(protocolMatch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type protocolMatch struct {
+	proto  Protocol
+	target Target
+}
+
+func (m protocolMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	for _, prefix := range m.proto {
+		if peekPrefix(br, prefix) {
+			return m.target
+		}
+	}
+	return nil
+}
+
+// peekPrefix reports whether the data of br starts with prefix, without
+// consuming it. It reads no more than needed to tell.
+func peekPrefix(br *bufio.Reader, prefix []byte) bool {
+	for peekSize := 1; ; peekSize++ {
+		if n := br.Buffered(); n > peekSize {
+			peekSize = n
+		}
+		if peekSize > len(prefix) {
+			peekSize = len(prefix)
+		}
+		b, err := br.Peek(peekSize)
+		if err != nil || !bytes.HasPrefix(prefix, b) {
+			return false
+		}
+		if len(b) == len(prefix) {
+			return true
+		}
+	}
+}
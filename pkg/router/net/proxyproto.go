@@ -0,0 +1,320 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol header versions, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// proxyV2Signature starts every binary (version 2) PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands, address families and TLV types.
+const (
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+
+	proxyV2FamUnspec = 0x00
+	proxyV2FamTCP4   = 0x11
+	proxyV2FamTCP6   = 0x21
+
+	proxyV2TypeALPN      = 0x01
+	proxyV2TypeAuthority = 0x02
+)
+
+// writeProxyHeader writes a PROXY protocol header of the given version
+// describing src to w. The source address is src.RemoteAddr() and the
+// destination is src.LocalAddr().
+func writeProxyHeader(w io.Writer, version int, src net.Conn) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(src.RemoteAddr(), src.LocalAddr())
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(src.RemoteAddr(), src.LocalAddr(), proxyTLVs(src))
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// writeLocalProxyHeader writes a PROXY protocol header of the given
+// version announcing no client, for connections of the proxy's own such
+// as health checks: the LOCAL command in v2, UNKNOWN in v1.
+func writeLocalProxyHeader(w io.Writer, version int) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(nil, nil)
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(nil, nil, nil)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns the IPs and ports of src and dst, with both IPs in
+// the same (4 or 16 byte) form. ok is false if they aren't TCP addresses
+// of the same family.
+func proxyAddrs(src, dst net.Addr) (srcIP, dstIP net.IP, srcPort, dstPort int, ok bool) {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return nil, nil, 0, 0, false
+	}
+	srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil, nil, 0, 0, false
+	}
+	return srcIP, dstIP, srcTCP.Port, dstTCP.Port, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcIP, dstIP, srcPort, dstPort, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if len(srcIP) == net.IPv6len {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort))
+}
+
+func proxyHeaderV2(src, dst net.Addr, tlvs []byte) []byte {
+	var addrs bytes.Buffer
+	cmd, fam := byte(proxyV2CmdProxy), byte(proxyV2FamTCP4)
+
+	srcIP, dstIP, srcPort, dstPort, ok := proxyAddrs(src, dst)
+	switch {
+	case !ok:
+		cmd, fam = proxyV2CmdLocal, proxyV2FamUnspec
+	case len(srcIP) == net.IPv6len:
+		fam = proxyV2FamTCP6
+		fallthrough
+	default:
+		addrs.Write(srcIP)
+		addrs.Write(dstIP)
+		binary.Write(&addrs, binary.BigEndian, uint16(srcPort))
+		binary.Write(&addrs, binary.BigEndian, uint16(dstPort))
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	header.WriteByte(cmd)
+	header.WriteByte(fam)
+	binary.Write(&header, binary.BigEndian, uint16(addrs.Len()+len(tlvs)))
+	header.Write(addrs.Bytes())
+	header.Write(tlvs)
+	return header.Bytes()
+}
+
+// proxyTLVs encodes the v2 TLVs describing what was learned about src
+// while matching routes.
+func proxyTLVs(src net.Conn) []byte {
+	conn, ok := src.(*Conn)
+	if !ok {
+		return nil
+	}
+	var tlvs bytes.Buffer
+	if len(conn.ALPN) > 0 {
+		writeTLV(&tlvs, proxyV2TypeALPN, []byte(conn.ALPN[0]))
+	}
+	if conn.HostName != "" {
+		writeTLV(&tlvs, proxyV2TypeAuthority, []byte(conn.HostName))
+	}
+	writeSSLTLVs(&tlvs, conn)
+	return tlvs.Bytes()
+}
+
+func writeTLV(w *bytes.Buffer, typ byte, value []byte) {
+	w.WriteByte(typ)
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.Write(value)
+}
+
+// AcceptProxyProtocol makes the ipPort listener read a PROXY protocol v1
+// or v2 header from connections coming from trustedIPs, before any route
+// is matched. The addresses it announces replace those of the connection.
+// trustedIPs holds IPs or CIDRs; connections from other sources are
+// served as is. Trusted sources that don't send the header within the
+// peek timeout (see SetPeekTimeout), or 10 seconds without one, are
+// closed. It must be called before Start.
+func (proxy *Proxy) AcceptProxyProtocol(ipPort string, trustedIPs []string) error {
+	nets, err := parseNetworks(trustedIPs)
+	if err != nil {
+		return err
+	}
+	proxy.configFor(ipPort).trustedProxies = nets
+	return nil
+}
+
+// parseNetworks parses a list of IPs and CIDRs.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustsProxy reports whether addr may send a PROXY protocol header.
+func (cfg *routerConfig) trustsProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range cfg.trustedProxies {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header on
+// listeners without a peek timeout.
+var proxyHeaderTimeout = 10 * time.Second
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from br and
+// returns the addresses it announces. Both are nil for headers that carry
+// no addresses (v1 UNKNOWN, v2 LOCAL or unsupported families).
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(br)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(br)
+	}
+	return nil, nil, errNoProxyHeader
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	// The longest v1 header, CRLF included, is 107 bytes.
+	const maxLen = 107
+	var line []byte
+	for peekSize := 1; line == nil; peekSize++ {
+		if peekSize > maxLen {
+			return nil, nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := br.Peek(peekSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i := bytes.Index(b, []byte("\r\n")); i >= 0 {
+			line = b[:i]
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	br.Discard(len(line) + 2)
+
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errNoProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	const fixedLen = 16
+	hdr, err := br.Peek(fixedLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, nil, errNoProxyHeader
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	// br must hold the whole header; bufio's default size is plenty
+	// for addresses and the usual TLVs.
+	b, err := br.Peek(fixedLen + length)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs := append([]byte(nil), b[fixedLen:]...)
+	br.Discard(fixedLen + length)
+
+	switch verCmd {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY protocol v2 command %#x", verCmd&0x0f)
+	}
+
+	var ipLen int
+	switch fam {
+	case proxyV2FamTCP4:
+		ipLen = net.IPv4len
+	case proxyV2FamTCP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, nil, errors.New("short PROXY protocol v2 address block")
+	}
+	srcIP, dstIP := net.IP(addrs[:ipLen]), net.IP(addrs[ipLen:2*ipLen])
+	ports := addrs[2*ipLen:]
+	srcPort, dstPort := binary.BigEndian.Uint16(ports[0:2]), binary.BigEndian.Uint16(ports[2:4])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
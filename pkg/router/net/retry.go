@@ -1,20 +1,154 @@
 package http
 
 import (
+	"sync"
 	"time"
 
 	"github.com/segmentio/ksuid"
 )
 
+// Retry configures how a Balancer retries a failed dial on the other
+// backends of its service before giving up on a connection.
+type Retry struct {
+	// Attempts is the number of dials made after the first one failed.
+	Attempts int
+	// InitialBackoff is the delay before the first retry; it doubles with
+	// each following one. Zero retries immediately.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two retries, if positive.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the delay before the given retry, counted from 1.
+func (retry *Retry) backoff(attempt int) time.Duration {
+	delay := retry.InitialBackoff
+	for i := 1; i < attempt && delay > 0; i++ {
+		delay *= 2
+		if retry.MaxBackoff > 0 && delay >= retry.MaxBackoff {
+			break
+		}
+	}
+	if retry.MaxBackoff > 0 && delay > retry.MaxBackoff {
+		delay = retry.MaxBackoff
+	}
+	return delay
+}
+
 //  queue of failed operations to retry as a circular buffer with a set of data structures that look something like this:
+//
+// Each bucket holds the items due within one tick of resolution; the
+// bucket at currentOffset is the one for currentTime. Items due further
+// away than the buffer spans wait in their bucket for another round.
 
 type retryQueue struct {
+	mu            sync.Mutex
+	resolution    time.Duration
 	buckets       [][]retryItem
 	currentTime   time.Time
 	currentOffset int
+	pending       int
+	running       bool
 }
 
 type retryItem struct {
-	id   ksuid.KSUID
-	time time.Time
+	id    ksuid.KSUID
+	time  time.Time
+	ready chan struct{}
+}
+
+const (
+	retryQueueResolution = 10 * time.Millisecond
+	retryQueueBuckets    = 512
+)
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{
+		resolution: retryQueueResolution,
+		buckets:    make([][]retryItem, retryQueueBuckets),
+	}
+}
+
+// schedule queues an item due after delay. The returned channel is
+// closed once it is due.
+func (queue *retryQueue) schedule(delay time.Duration) (ksuid.KSUID, <-chan struct{}) {
+	item := retryItem{
+		id:    ksuid.New(),
+		time:  time.Now().Add(delay),
+		ready: make(chan struct{}),
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if !queue.running {
+		queue.currentTime = time.Now()
+		queue.running = true
+		go queue.run()
+	}
+
+	ticks := int((item.time.Sub(queue.currentTime) + queue.resolution - 1) / queue.resolution)
+	if ticks < 1 {
+		ticks = 1
+	}
+	slot := (queue.currentOffset + ticks) % len(queue.buckets)
+	queue.buckets[slot] = append(queue.buckets[slot], item)
+	queue.pending++
+
+	return item.id, item.ready
+}
+
+// cancel removes the item id from the queue, if still pending.
+func (queue *retryQueue) cancel(id ksuid.KSUID) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for slot, bucket := range queue.buckets {
+		for i, item := range bucket {
+			if item.id == id {
+				queue.buckets[slot] = append(bucket[:i], bucket[i+1:]...)
+				queue.pending--
+				return
+			}
+		}
+	}
+}
+
+// run advances the queue every tick until no item is pending.
+func (queue *retryQueue) run() {
+	ticker := time.NewTicker(queue.resolution)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !queue.advance(now) {
+			return
+		}
+	}
+}
+
+// advance fires the items due by now and reports whether any are left.
+func (queue *retryQueue) advance(now time.Time) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for !queue.currentTime.Add(queue.resolution).After(now) {
+		queue.currentTime = queue.currentTime.Add(queue.resolution)
+		queue.currentOffset = (queue.currentOffset + 1) % len(queue.buckets)
+
+		bucket := queue.buckets[queue.currentOffset]
+		kept := bucket[:0]
+		for _, item := range bucket {
+			if item.time.After(now) {
+				kept = append(kept, item)
+				continue
+			}
+			close(item.ready)
+			queue.pending--
+		}
+		queue.buckets[queue.currentOffset] = kept
+	}
+
+	if queue.pending == 0 {
+		queue.running = false
+	}
+	return queue.running
 }
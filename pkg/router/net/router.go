@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net"
 	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anabiozz/rproxy/pkg/log"
@@ -20,14 +22,43 @@ type Proxy struct {
 	donec      chan struct{}
 	err        error
 	ListenFunc func(net, laddr string) (net.Listener, error)
+
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{} // connections being served
+	shuttingDown bool
+
+	configMu sync.Mutex // guards configs, route table updates and Start
 }
 
 type routerConfig struct {
-	routes []route
+	ipPort string
+	// routes holds the []namedRoute of the listener. It is replaced as a
+	// whole on every change, so connections match against a consistent
+	// snapshot while routes are updated.
+	routes atomic.Value
+	// trustedProxies lists the networks allowed to send a PROXY protocol
+	// header; nil disables PROXY protocol parsing.
+	trustedProxies []*net.IPNet
+	// peekTimeout bounds the wait for the bytes routes match on.
+	peekTimeout time.Duration
+	// tlsConfig terminates TLS on the listener if not nil.
+	tlsConfig *tls.Config
+	// fallback holds the fallbackTarget of the connections no route
+	// matches.
+	fallback atomic.Value
 }
 
-type route interface {
-	match(*bufio.Reader) (Target, string)
+// Route reports the target for a connection, or nil if it doesn't match.
+// Metadata learned while matching (e.g. the SNI hostname) is recorded on
+// the passed Conn. Routes are built by FixedRoute, SNIRoute and the other
+// *Route functions of this package.
+type Route interface {
+	match(ctx context.Context, conn *Conn, br *bufio.Reader) Target
+}
+
+type namedRoute struct {
+	name string // empty for routes added by the Add*Route methods
+	Route
 }
 
 // Target ..
@@ -38,19 +69,56 @@ type Target interface {
 // Matcher ..
 type Matcher func(ctx context.Context, hostname string) bool
 
+// FixedRoute returns a Route matching every connection to dest.
+func FixedRoute(dest Target) Route {
+	return fixedTarget{dest}
+}
+
 type fixedTarget struct {
 	target Target
 }
 
-func (m fixedTarget) match(*bufio.Reader) (Target, string) {
-	return m.target, ""
+func (m fixedTarget) match(context.Context, *Conn, *bufio.Reader) Target {
+	return m.target
 }
 
 // Conn ..
 type Conn struct {
 	HostName string
-	Peeked   []byte
+	// ALPN holds the protocols offered in the TLS ClientHello, if any, or
+	// the one negotiated if the proxy terminated TLS.
+	ALPN   []string
+	Peeked []byte
+	// TLS is the state of the TLS connection terminated by the proxy, if
+	// any. Conn is then the *tls.Conn.
+	TLS *tls.ConnectionState
 	net.Conn
+
+	// remoteAddr and localAddr override the addresses of Conn when
+	// announced by a PROXY protocol header.
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// postgresSSL is set once the Postgres SSLRequest of the client was
+	// accepted, before its TLS handshake.
+	postgresSSL bool
+}
+
+// RemoteAddr returns the client address, as announced by a trusted PROXY
+// protocol header if there was one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, as announced by
+// a trusted PROXY protocol header if there was one.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
 }
 
 // UnderlyingConn returns underlying connection
@@ -71,26 +139,87 @@ func (proxy *Proxy) Close() error {
 
 // AddRoute ..
 func (proxy *Proxy) AddRoute(ipPort string, dest Target) {
-	proxy.addRoute(ipPort, fixedTarget{dest})
+	proxy.addRoute(ipPort, FixedRoute(dest))
+}
+
+func (proxy *Proxy) addRoute(ipPort string, route Route) {
+	proxy.updateRoutes(ipPort, func(routes []namedRoute) []namedRoute {
+		return append(routes, namedRoute{"", route})
+	})
+}
+
+// SetRoute adds route to the ipPort listener under name, or replaces the
+// route already known by that name, keeping its position. It is safe to
+// call on a running Proxy; connections already routed are unaffected.
+// A running Proxy only serves the ipPorts it was started with: listening
+// on another one takes a new Proxy.
+func (proxy *Proxy) SetRoute(ipPort, name string, route Route) {
+	proxy.updateRoutes(ipPort, func(routes []namedRoute) []namedRoute {
+		for i := range routes {
+			if routes[i].name == name {
+				routes[i].Route = route
+				return routes
+			}
+		}
+		return append(routes, namedRoute{name, route})
+	})
 }
 
-func (proxy *Proxy) addRoute(ipPort string, route route) {
-	cfg := proxy.configFor(ipPort)
-	cfg.routes = append(cfg.routes, route)
+// RemoveRoute removes the route known by name from the ipPort listener
+// and reports whether there was one. It is safe to call on a running
+// Proxy.
+func (proxy *Proxy) RemoveRoute(ipPort, name string) bool {
+	removed := false
+	proxy.updateRoutes(ipPort, func(routes []namedRoute) []namedRoute {
+		for i := range routes {
+			if routes[i].name == name {
+				removed = true
+				return append(routes[:i], routes[i+1:]...)
+			}
+		}
+		return routes
+	})
+	return removed
+}
+
+// updateRoutes replaces the routes of the ipPort listener by the result
+// of update, which is passed a copy it may modify.
+func (proxy *Proxy) updateRoutes(ipPort string, update func([]namedRoute) []namedRoute) {
+	proxy.configMu.Lock()
+	defer proxy.configMu.Unlock()
+
+	cfg := proxy.configLocked(ipPort)
+	routes := append([]namedRoute(nil), cfg.loadRoutes()...)
+	cfg.routes.Store(update(routes))
+}
+
+func (cfg *routerConfig) loadRoutes() []namedRoute {
+	routes, _ := cfg.routes.Load().([]namedRoute)
+	return routes
 }
 
 func (proxy *Proxy) configFor(ipPort string) *routerConfig {
+	proxy.configMu.Lock()
+	defer proxy.configMu.Unlock()
+	return proxy.configLocked(ipPort)
+}
+
+func (proxy *Proxy) configLocked(ipPort string) *routerConfig {
 	if proxy.configs == nil {
 		proxy.configs = make(map[string]*routerConfig)
 	}
 	if proxy.configs[ipPort] == nil {
-		proxy.configs[ipPort] = &routerConfig{}
+		proxy.configs[ipPort] = &routerConfig{ipPort: ipPort}
 	}
 	return proxy.configs[ipPort]
 }
 
-// Start ..
+// Start listens on every ipPort routes were added for. An ipPort
+// prefixed with "unix://" is a unix socket path.
 func (proxy *Proxy) Start(ctx context.Context) error {
+	proxy.configMu.Lock()
+	defer proxy.configMu.Unlock()
+
 	if proxy.donec != nil {
 		return errors.New("already started")
 	}
@@ -101,7 +230,7 @@ func (proxy *Proxy) Start(ctx context.Context) error {
 
 	for ipPort, config := range proxy.configs {
 
-		listener, err := proxy.netListen()("tcp", ipPort)
+		listener, err := proxy.netListen()(splitNetwork(ipPort))
 		if err != nil {
 			proxy.Close()
 			return err
@@ -109,7 +238,7 @@ func (proxy *Proxy) Start(ctx context.Context) error {
 
 		proxy.listeners = append(proxy.listeners, listener)
 
-		go proxy.serveListener(ctx, errc, listener, config.routes)
+		go proxy.serveListener(ctx, errc, listener, config)
 	}
 	go proxy.awaitFirstError(errc)
 	return nil
@@ -120,11 +249,29 @@ func (proxy *Proxy) awaitFirstError(errc <-chan error) {
 	close(proxy.donec)
 }
 
-func (proxy *Proxy) serveListener(ctx context.Context, errc chan<- error, listener net.Listener, routes []route) {
+func (proxy *Proxy) serveListener(ctx context.Context, errc chan<- error, listener net.Listener, config *routerConfig) {
 
 	ctxLog := log.NewContext(ctx, log.Str("function", "serveListener"))
 	logger := log.WithContext(ctxLog)
 
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		if !proxy.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go proxy.serveConn(httptrace.WithClientTrace(ctx, newClientTrace(logger)), conn, config)
+	}
+}
+
+// newClientTrace returns a trace logging the timings of the dials of one
+// connection.
+func newClientTrace(logger log.Logger) *httptrace.ClientTrace {
 	var start, connect, dns, tlsHandshake time.Time
 
 	start = time.Now()
@@ -162,47 +309,99 @@ func (proxy *Proxy) serveListener(ctx context.Context, errc chan<- error, listen
 		},
 	}
 
-	ctx = httptrace.WithClientTrace(ctx, trace)
+	return trace
+}
 
-	for {
-		conn, err := listener.Accept()
+// peekBufferSize is the size of the buffer routes peek the first bytes of
+// a connection into. It holds a TLS record of the largest size, so that
+// any ClientHello sent in one record fits.
+const peekBufferSize = 5 + 16384
+
+func (proxy *Proxy) serveConn(ctx context.Context, conn net.Conn, config *routerConfig) {
+
+	defer proxy.trackConn(conn, false)
+
+	bufreader := bufio.NewReaderSize(conn, peekBufferSize)
+	wrapped := &Conn{Conn: conn}
+
+	peekTimeout := config.loadPeekTimeout()
+	if peekTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	}
+
+	if config.trustsProxy(conn.RemoteAddr()) {
+		if peekTimeout <= 0 {
+			conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		}
+		src, dst, err := readProxyHeader(bufreader)
 		if err != nil {
-			errc <- err
+			fmt.Printf("reading PROXY header from conn %v/%v: %v; closing\n", conn.RemoteAddr().String(), conn.LocalAddr().String(), err)
+			conn.Close()
 			return
 		}
-
-		go proxy.serveConn(ctx, conn, routes)
+		if peekTimeout <= 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+		wrapped.remoteAddr, wrapped.localAddr = src, dst
 	}
-}
 
-func (proxy *Proxy) serveConn(ctx context.Context, conn net.Conn, routes []route) {
+	if config.tlsConfig != nil {
+		if peekTimeout <= 0 {
+			conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		}
+		if hasPostgresRoutes(config.loadRoutes()) {
+			acceptPostgresSSLRequest(wrapped, bufreader)
+		}
+		tlsConn, err := terminateTLS(bufreader, conn, config.tlsConfig)
+		if err != nil {
+			fmt.Printf("TLS handshake with conn %v/%v: %v; closing\n", wrapped.RemoteAddr().String(), wrapped.LocalAddr().String(), err)
+			conn.Close()
+			return
+		}
+		if peekTimeout <= 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		state := tlsConn.ConnectionState()
+		wrapped.Conn, wrapped.TLS, wrapped.HostName = tlsConn, &state, state.ServerName
+		if state.NegotiatedProtocol != "" {
+			wrapped.ALPN = []string{state.NegotiatedProtocol}
+		}
+		bufreader = bufio.NewReaderSize(tlsConn, peekBufferSize)
+	}
 
-	bufreader := bufio.NewReader(conn)
+	target := config.route(ctx, wrapped, bufreader)
+	if target == nil {
+		unmatchedConns.Add(config.ipPort, 1)
+		if target = config.loadFallback(); target == nil {
+			fmt.Printf("no routes matched conn %v/%v; closing\n", wrapped.RemoteAddr().String(), wrapped.LocalAddr().String())
+			conn.Close()
+			return
+		}
+	}
 
-	for _, route := range routes {
-		if target, hostName := route.match(bufreader); target != nil {
+	if peekTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
 
-			if n := bufreader.Buffered(); n > 0 {
-				peeked, err := bufreader.Peek(bufreader.Buffered())
-				if err != nil {
-					fmt.Println(err)
-				}
+	if n := bufreader.Buffered(); n > 0 {
+		peeked, err := bufreader.Peek(bufreader.Buffered())
+		if err != nil {
+			fmt.Println(err)
+		}
+		wrapped.Peeked = peeked
+	}
 
-				conn = &Conn{
-					HostName: hostName,
-					Peeked:   peeked,
-					Conn:     conn,
-				}
-			}
+	target.HandleConn(ctx, wrapped)
+}
 
-			target.HandleConn(ctx, conn)
-			return
+// route returns the target of the first route matching conn, or nil.
+func (cfg *routerConfig) route(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	for _, route := range cfg.loadRoutes() {
+		if target := route.match(ctx, conn, br); target != nil {
+			return target
 		}
 	}
-
-	fmt.Printf("no routes matched conn %v/%v; closing\n", conn.RemoteAddr().String(), conn.LocalAddr().String())
-	conn.Close()
-	return
+	return nil
 }
 
 // if ListenFunc not chosen, net.Listen will be return
@@ -217,7 +416,3 @@ func (proxy *Proxy) netListen() func(net, laddr string) (net.Listener, error) {
 var (
 	ErrInvalidService = errors.New("invalid service/version")
 )
-
-func loadBalance(network, serviceName, serviceVersion string) (net.Conn, error) {
-	return nil, nil
-}
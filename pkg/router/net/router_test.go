@@ -1,13 +1,31 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newLocalListener(t *testing.T) net.Listener {
@@ -50,7 +68,8 @@ func TestProxyPROXYOut(t *testing.T) {
 
 	proxy := testProxy(t, front)
 	proxy.AddRoute(testFrontAddr, &DialProxy{
-		Addr: back.Addr().String(),
+		Addr:                 back.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV1,
 	})
 	if err := proxy.Start(context.Background()); err != nil {
 		t.Fatal(err)
@@ -62,7 +81,7 @@ func TestProxyPROXYOut(t *testing.T) {
 	}
 
 	io.WriteString(toFront, "GET / HTTP/1.1\r\nHost: 127.0.0.1:9595\r\n\r\n")
-	defer toFront.Close()
+	toFront.Close()
 
 	fromProxy, err := back.Accept()
 	if err != nil {
@@ -74,12 +93,88 @@ func TestProxyPROXYOut(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	want := fmt.Sprintf("PROXY TCP4 %s %d %s %d\r\nGET / HTTP/1.1\r\nHost: 127.0.0.1:9595\r\n\r\n", toFront.LocalAddr().(*net.TCPAddr).IP, toFront.LocalAddr().(*net.TCPAddr).Port, toFront.RemoteAddr().(*net.TCPAddr).IP, toFront.RemoteAddr().(*net.TCPAddr).Port)
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\nGET / HTTP/1.1\r\nHost: 127.0.0.1:9595\r\n\r\n", toFront.LocalAddr().(*net.TCPAddr).IP, toFront.RemoteAddr().(*net.TCPAddr).IP, toFront.LocalAddr().(*net.TCPAddr).Port, toFront.RemoteAddr().(*net.TCPAddr).Port)
 	if string(bs) != want {
 		t.Fatalf("got %q; want %q", bs, want)
 	}
 }
 
+func TestProxyPROXYOutV2(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	proxy := testProxy(t, front)
+	proxy.AddSNIRoute(testFrontAddr, "foo.com", &DialProxy{
+		Addr:                 back.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV2,
+	})
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	go tls.Client(toFront, &tls.Config{ServerName: "foo.com", NextProtos: []string{"h2"}}).Handshake()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(fromProxy, header); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		t.Fatalf("got signature %q; want %q", header[:12], proxyV2Signature)
+	}
+	if header[12] != proxyV2CmdProxy || header[13] != proxyV2FamTCP4 {
+		t.Fatalf("got command %#x, family %#x; want PROXY over TCP4", header[12], header[13])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(fromProxy, body); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := toFront.LocalAddr().(*net.TCPAddr), toFront.RemoteAddr().(*net.TCPAddr)
+	if ip := net.IP(body[0:4]); !ip.Equal(src.IP) {
+		t.Errorf("got source IP %v; want %v", ip, src.IP)
+	}
+	if ip := net.IP(body[4:8]); !ip.Equal(dst.IP) {
+		t.Errorf("got destination IP %v; want %v", ip, dst.IP)
+	}
+	if port := int(binary.BigEndian.Uint16(body[8:])); port != src.Port {
+		t.Errorf("got source port %d; want %d", port, src.Port)
+	}
+	if port := int(binary.BigEndian.Uint16(body[10:])); port != dst.Port {
+		t.Errorf("got destination port %d; want %d", port, dst.Port)
+	}
+
+	tlvs := make(map[byte]string)
+	for rest := body[12:]; len(rest) > 0; {
+		if len(rest) < 3 || len(rest) < 3+int(binary.BigEndian.Uint16(rest[1:])) {
+			t.Fatalf("truncated TLV %q", rest)
+		}
+		n := 3 + int(binary.BigEndian.Uint16(rest[1:]))
+		tlvs[rest[0]] = string(rest[3:n])
+		rest = rest[n:]
+	}
+	want := map[byte]string{proxyV2TypeALPN: "h2", proxyV2TypeAuthority: "foo.com"}
+	if !reflect.DeepEqual(tlvs, want) {
+		t.Errorf("got TLVs %q; want %q", tlvs, want)
+	}
+
+	if clientHello(bufio.NewReader(fromProxy)) == nil {
+		t.Error("backend did not receive the ClientHello after the header")
+	}
+}
+
 func TestProxyAlwaysMatch(t *testing.T) {
 	front := newLocalListener(t)
 	defer front.Close()
@@ -113,3 +208,1839 @@ func TestProxyAlwaysMatch(t *testing.T) {
 		t.Fatalf("got %q; want %q", buf, msg)
 	}
 }
+
+func TestProxySNI(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backFoo := newLocalListener(t)
+	defer backFoo.Close()
+	backWild := newLocalListener(t)
+	defer backWild.Close()
+
+	p := testProxy(t, front)
+	p.AddSNIRoute(testFrontAddr, "foo.com", To(backFoo.Addr().String()))
+	p.AddSNIRoute(testFrontAddr, "*.example.com", To(backWild.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	go tls.Client(toFront, &tls.Config{ServerName: "a.example.com"}).Handshake()
+
+	fromProxy, err := backWild.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	br := bufio.NewReader(fromProxy)
+	hello := clientHello(br)
+	if hello == nil {
+		t.Fatal("backend did not receive a ClientHello")
+	}
+	if hello.ServerName != "a.example.com" {
+		t.Fatalf("got server name %q; want %q", hello.ServerName, "a.example.com")
+	}
+}
+
+func TestProxySNILargeClientHello(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddSNIRoute(testFrontAddr, "foo.com", To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	// Enough protocols to make the ClientHello outgrow bufio's default
+	// 4096 byte buffer.
+	var protos []string
+	for i := 0; i < 40; i++ {
+		protos = append(protos, fmt.Sprintf("%03d%s", i, strings.Repeat("x", 200)))
+	}
+	go tls.Client(toFront, &tls.Config{ServerName: "foo.com", NextProtos: protos}).Handshake()
+
+	back.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatalf("ClientHello not routed: %v", err)
+	}
+	defer fromProxy.Close()
+
+	hello := clientHello(bufio.NewReaderSize(fromProxy, peekBufferSize))
+	if hello == nil {
+		t.Fatal("backend did not receive the ClientHello")
+	}
+	if hello.ServerName != "foo.com" || len(hello.SupportedProtos) != len(protos) {
+		t.Fatalf("got server name %q and %d protocols; want %q and %d", hello.ServerName, len(hello.SupportedProtos), "foo.com", len(protos))
+	}
+}
+
+func TestProxyALPN(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backH2 := newLocalListener(t)
+	defer backH2.Close()
+	backACME := newLocalListener(t)
+	defer backACME.Close()
+	backFoo := newLocalListener(t)
+	defer backFoo.Close()
+
+	p := testProxy(t, front)
+	p.AddALPNRoute(testFrontAddr, "", "acme-tls/1", To(backACME.Addr().String()))
+	p.AddALPNRoute(testFrontAddr, "foo.com", "h2", To(backH2.Addr().String()))
+	p.AddSNIRoute(testFrontAddr, "foo.com", To(backFoo.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		protos []string
+		back   net.Listener
+	}{
+		{[]string{"h2", "http/1.1"}, backH2},
+		{[]string{"http/1.1"}, backFoo},
+		{[]string{"acme-tls/1"}, backACME},
+	}
+	for _, tt := range tests {
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go tls.Client(toFront, &tls.Config{ServerName: "foo.com", NextProtos: tt.protos}).Handshake()
+
+		fromProxy, err := tt.back.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := clientHello(bufio.NewReader(fromProxy))
+		if hello == nil {
+			t.Fatalf("%v: backend did not receive a ClientHello", tt.protos)
+		}
+		if !reflect.DeepEqual(hello.SupportedProtos, tt.protos) {
+			t.Errorf("got protocols %v; want %v", hello.SupportedProtos, tt.protos)
+		}
+		fromProxy.Close()
+		toFront.Close()
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backTLS := newLocalListener(t)
+	defer backTLS.Close()
+	backHTTP := newLocalListener(t)
+	defer backHTTP.Close()
+	backSSH := newLocalListener(t)
+	defer backSSH.Close()
+	backCustom := newLocalListener(t)
+	defer backCustom.Close()
+	backFallback := newLocalListener(t)
+	defer backFallback.Close()
+
+	p := testProxy(t, front)
+	p.SetPeekTimeout(testFrontAddr, 100*time.Millisecond)
+	p.AddProtocolRoute(testFrontAddr, ProtocolTLS, To(backTLS.Addr().String()))
+	p.AddProtocolRoute(testFrontAddr, ProtocolHTTP, To(backHTTP.Addr().String()))
+	p.AddProtocolRoute(testFrontAddr, ProtocolSSH, To(backSSH.Addr().String()))
+	p.AddProtocolRoute(testFrontAddr, Protocol{[]byte("\x00\x01custom")}, To(backCustom.Addr().String()))
+	p.AddRoute(testFrontAddr, To(backFallback.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		msg  string
+		back net.Listener
+	}{
+		{"\x16\x03\x01\x00\x05hello", backTLS},
+		{"GET / HTTP/1.1\r\nHost: foo.com\r\n\r\n", backHTTP},
+		{"SSH-2.0-OpenSSH_8.0\r\n", backSSH},
+		{"\x00\x01custom protocol", backCustom},
+		{"GEX", backFallback},
+		{"SSH", backFallback}, // cut short, until the peek timeout
+		{"", backFallback},    // server speaks first
+	}
+	for _, tt := range tests {
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(toFront, tt.msg)
+
+		fromProxy, err := tt.back.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(tt.msg))
+		if _, err := io.ReadFull(fromProxy, buf); err != nil {
+			t.Fatalf("%q: %v", tt.msg, err)
+		}
+		if string(buf) != tt.msg {
+			t.Errorf("got %q; want %q", buf, tt.msg)
+		}
+		fromProxy.Close()
+		toFront.Close()
+	}
+}
+
+func TestProxyProtocolDefaultPeekTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { protocolPeekTimeout = timeout }(protocolPeekTimeout)
+	protocolPeekTimeout = 50 * time.Millisecond
+
+	front := newLocalListener(t)
+	defer front.Close()
+	backSSH := newLocalListener(t)
+	defer backSSH.Close()
+	backFallback := newLocalListener(t)
+	defer backFallback.Close()
+
+	p := testProxy(t, front)
+	p.AddProtocolRoute(testFrontAddr, ProtocolSSH, To(backSSH.Addr().String()))
+	p.AddRoute(testFrontAddr, To(backFallback.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a peek timeout set, a client waiting for the server to
+	// speak first still reaches the fallback.
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromProxy, err := backFallback.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromProxy.Close()
+	toFront.Close()
+
+	// Done with the connection before protocolPeekTimeout is restored.
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyTerminateTLSPostgres(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "db", "db.example.com")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "db.crt"), filepath.Join(dir, "db.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	front := newLocalListener(t)
+	defer front.Close()
+	frontNoDB := newLocalListener(t)
+	defer frontNoDB.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.TerminateTLS(testFrontAddr, tlsConfig)
+	p.AddPostgresSNIRoute(testFrontAddr, "db.example.com", To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pNoDB := testProxy(t, frontNoDB)
+	pNoDB.TerminateTLS(testFrontAddr, tlsConfig)
+	pNoDB.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := pNoDB.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sslRequest := func(front net.Listener) (net.Conn, byte) {
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		toFront.Write(postgresSSLRequest)
+		toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 1)
+		toFront.Read(reply)
+		toFront.SetReadDeadline(time.Time{})
+		return toFront, reply[0]
+	}
+
+	// Without Postgres routes, the SSLRequest is no TLS handshake.
+	toFront, reply := sslRequest(frontNoDB)
+	toFront.Close()
+	if reply == 'S' {
+		t.Fatal("SSLRequest accepted on a listener without Postgres routes")
+	}
+
+	// With them, the proxy accepts it and terminates TLS.
+	toFront, reply = sslRequest(front)
+	defer toFront.Close()
+	if reply != 'S' {
+		t.Fatalf("got reply %q to SSLRequest; want 'S'", reply)
+	}
+	tlsConn := tls.Client(toFront, &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true})
+	const msg = "startup"
+	io.WriteString(tlsConn, msg)
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestProxyPostgresSNI(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backDB1 := newLocalListener(t)
+	defer backDB1.Close()
+	backDB2 := newLocalListener(t)
+	defer backDB2.Close()
+
+	p := testProxy(t, front)
+	p.AddPostgresSNIRoute(testFrontAddr, "db1.example.com", To(backDB1.Addr().String()))
+	p.AddPostgresSNIRoute(testFrontAddr, "db2.example.com", To(backDB2.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	toFront.Write(postgresSSLRequest)
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(toFront, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 'S' {
+		t.Fatalf("got SSLRequest reply %q; want 'S'", reply[0])
+	}
+	go tls.Client(toFront, &tls.Config{ServerName: "db2.example.com"}).Handshake()
+
+	fromProxy, err := backDB2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	request := make([]byte, len(postgresSSLRequest))
+	if _, err := io.ReadFull(fromProxy, request); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, postgresSSLRequest) {
+		t.Fatalf("backend got %q; want the SSLRequest", request)
+	}
+	fromProxy.Write([]byte{'S'})
+
+	hello := clientHello(bufio.NewReader(fromProxy))
+	if hello == nil {
+		t.Fatal("backend did not receive a ClientHello")
+	}
+	if hello.ServerName != "db2.example.com" {
+		t.Fatalf("got server name %q; want %q", hello.ServerName, "db2.example.com")
+	}
+}
+
+// mqttConnectPacket builds an MQTT CONNECT packet with a will message.
+func mqttConnectPacket(level byte, clientID, username string) []byte {
+	str := func(b *bytes.Buffer, s string) {
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	var body bytes.Buffer
+	str(&body, "MQTT")
+	body.WriteByte(level)
+	flags := byte(0x04 | 0x02) // will, clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	body.WriteByte(flags)
+	body.Write([]byte{0, 60}) // keep alive
+	if level >= 5 {
+		body.Write([]byte{5, 0x11, 0, 0, 0, 10}) // session expiry interval
+	}
+	str(&body, clientID)
+	if level >= 5 {
+		body.WriteByte(0) // will properties
+	}
+	str(&body, "status/"+clientID)
+	str(&body, "offline")
+	if username != "" {
+		str(&body, username)
+	}
+
+	packet := []byte{0x10}
+	for n := body.Len(); ; {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body.Bytes()...)
+}
+
+func TestProxyMQTT(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backSensors := newLocalListener(t)
+	defer backSensors.Close()
+	backAdmin := newLocalListener(t)
+	defer backAdmin.Close()
+
+	p := testProxy(t, front)
+	p.AddMQTTRoute(testFrontAddr, func(ctx context.Context, connect *MQTTConnect) bool {
+		return strings.HasPrefix(connect.ClientID, "sensor-")
+	}, To(backSensors.Addr().String()))
+	p.AddMQTTRoute(testFrontAddr, func(ctx context.Context, connect *MQTTConnect) bool {
+		return connect.ProtocolLevel == 5 && connect.Username == "admin"
+	}, To(backAdmin.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		packet []byte
+		back   net.Listener
+	}{
+		{mqttConnectPacket(4, "sensor-1", ""), backSensors},
+		{mqttConnectPacket(5, "sensor-2", "device"), backSensors},
+		{mqttConnectPacket(5, "console", "admin"), backAdmin},
+		{mqttConnectPacket(4, "console-"+strings.Repeat("x", 200), "admin"), nil},
+	}
+	for _, tt := range tests {
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		toFront.Write(tt.packet)
+
+		if tt.back == nil {
+			toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := toFront.Read(make([]byte, 1)); err == nil {
+				t.Errorf("unmatched client not closed")
+			}
+			toFront.Close()
+			continue
+		}
+		fromProxy, err := tt.back.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(tt.packet))
+		if _, err := io.ReadFull(fromProxy, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, tt.packet) {
+			t.Errorf("got %q; want %q", buf, tt.packet)
+		}
+		fromProxy.Close()
+		toFront.Close()
+	}
+}
+
+func TestProxyFallback(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+	backFallback := newLocalListener(t)
+	defer backFallback.Close()
+
+	p := testProxy(t, front)
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", To(back.Addr().String()))
+	p.SetFallback(testFrontAddr, Respond{HTTPErrorResponse(421)})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	unmatched := func() int64 {
+		v, _ := unmatchedConns.Get(testFrontAddr).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := unmatched()
+
+	const msg = "GET / HTTP/1.1\r\nHost: bar.com\r\n\r\n"
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	io.WriteString(toFront, msg)
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ioutil.ReadAll(toFront)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 421 Misdirected Request\r\n")) {
+		t.Fatalf("got response %q; want a 421", resp)
+	}
+	if got := unmatched() - before; got != 1 {
+		t.Fatalf("counted %d unmatched connections; want 1", got)
+	}
+
+	p.SetFallback(testFrontAddr, To(backFallback.Addr().String()))
+	toFront2, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront2.Close()
+	io.WriteString(toFront2, msg)
+
+	fromProxy, err := backFallback.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestProxyHTTPHost(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backFoo := newLocalListener(t)
+	defer backFoo.Close()
+	backBar := newLocalListener(t)
+	defer backBar.Close()
+
+	p := testProxy(t, front)
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", To(backFoo.Addr().String()))
+	p.AddHTTPHostRoute(testFrontAddr, "bar.com", To(backBar.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	const msg = "GET / HTTP/1.1\r\nHost: bar.com:8080\r\n\r\n"
+	io.WriteString(toFront, msg)
+
+	fromProxy, err := backBar.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestProxySetRoute(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backOld := newLocalListener(t)
+	defer backOld.Close()
+	backNew := newLocalListener(t)
+	defer backNew.Close()
+
+	p := testProxy(t, front)
+	p.SetRoute(testFrontAddr, "foo", HTTPHostRoute("foo.com", To(backOld.Addr().String())))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "GET / HTTP/1.1\r\nHost: foo.com\r\n\r\n"
+	dial := func(back net.Listener) (toFront, fromProxy net.Conn) {
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(toFront, msg)
+		fromProxy, err = back.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(fromProxy, buf); err != nil {
+			t.Fatal(err)
+		}
+		return toFront, fromProxy
+	}
+
+	oldClient, oldBack := dial(backOld)
+	defer oldClient.Close()
+	defer oldBack.Close()
+
+	// Replacing the route sends new connections to the new target and
+	// leaves established ones alone.
+	p.SetRoute(testFrontAddr, "foo", HTTPHostRoute("foo.com", To(backNew.Addr().String())))
+	newClient, newBack := dial(backNew)
+	newClient.Close()
+	newBack.Close()
+
+	io.WriteString(oldBack, "still up")
+	buf := make([]byte, len("still up"))
+	if _, err := io.ReadFull(oldClient, buf); err != nil {
+		t.Fatalf("established connection broken by route update: %v", err)
+	}
+
+	if !p.RemoveRoute(testFrontAddr, "foo") {
+		t.Fatal("RemoveRoute found no route foo")
+	}
+	if p.RemoveRoute(testFrontAddr, "foo") {
+		t.Fatal("RemoveRoute removed route foo twice")
+	}
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	io.WriteString(toFront, msg)
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := toFront.Read(buf); err == nil {
+		t.Fatalf("read %q with no routes; want the connection closed", buf[:n])
+	}
+}
+
+func TestProxyStartWhileSettingRoutes(t *testing.T) {
+	p := &Proxy{
+		ListenFunc: func(network, laddr string) (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+	}
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		p.AddRoute(fmt.Sprintf("127.0.0.1:%d", 7000+i), To("127.0.0.1:1"))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.SetRoute(fmt.Sprintf("127.0.0.1:%d", 8000+i), "route", FixedRoute(To("127.0.0.1:1")))
+		}
+	}()
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestProxyPROXYIn(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	middle := newLocalListener(t)
+	defer middle.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	// front sends a v2 header to middle, which trusts it and passes the
+	// original client addresses on to back as a v1 header.
+	p1 := testProxy(t, front)
+	p1.AddRoute(testFrontAddr, &DialProxy{
+		Addr:                 middle.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV2,
+	})
+	if err := p1.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := testProxy(t, middle)
+	if err := p2.AcceptProxyProtocol(testFrontAddr, []string{"127.0.0.0/8", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	p2.AddRoute(testFrontAddr, &DialProxy{
+		Addr:                 back.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV1,
+	})
+	if err := p2.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(toFront, "foo")
+	toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(fromProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, frontAddr := toFront.LocalAddr().(*net.TCPAddr), toFront.RemoteAddr().(*net.TCPAddr)
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\nfoo", client.IP, frontAddr.IP, client.Port, frontAddr.Port)
+	if string(bs) != want {
+		t.Fatalf("got %q; want %q", bs, want)
+	}
+}
+
+func TestReadProxyHeaderV2Command(t *testing.T) {
+	header := func(verCmd byte) []byte {
+		b := append([]byte(nil), proxyV2Signature...)
+		return append(b, verCmd, proxyV2FamUnspec, 0, 0)
+	}
+	if _, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header(proxyV2CmdLocal)))); err != nil {
+		t.Errorf("LOCAL command: %v", err)
+	}
+	if _, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header(0x22)))); err == nil {
+		t.Error("unknown command accepted")
+	}
+}
+
+func TestProxyPROXYHeaderTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { proxyHeaderTimeout = timeout }(proxyHeaderTimeout)
+	proxyHeaderTimeout = 50 * time.Millisecond
+
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	if err := p.AcceptProxyProtocol(testFrontAddr, []string{"127.0.0.0/8", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := toFront.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v; want the silent client closed", err)
+	}
+}
+
+func TestProxyTLSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { tlsHandshakeTimeout = timeout }(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = 50 * time.Millisecond
+
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.TerminateTLS(testFrontAddr, &tls.Config{})
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := toFront.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v; want the silent client closed", err)
+	}
+}
+
+func TestBalancerRetry(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+	dead := newLocalListener(t)
+	dead.Close()
+
+	balancer, err := NewBalancer(RoundRobin, []*Backend{
+		{DialProxy: To(dead.Addr().String())},
+		{DialProxy: To(back.Addr().String())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer.Retry = &Retry{Attempts: 1, InitialBackoff: 20 * time.Millisecond}
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, balancer)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	const msg = "foo"
+	io.WriteString(toFront, msg)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	up := newLocalListener(t)
+	defer up.Close()
+	down := newLocalListener(t)
+	down.Close()
+
+	balancer, err := NewBalancer(RoundRobin, []*Backend{
+		{DialProxy: To(down.Addr().String())},
+		{DialProxy: To(up.Addr().String())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer.HealthCheck = &HealthCheck{Interval: 10 * time.Millisecond, Timeout: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	balancer.StartHealthChecks(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(balancer.available()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d available backends; want 1", len(balancer.available()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := balancer.available()[0]; got.Addr != up.Addr().String() {
+		t.Fatalf("available backend is %s; want %s", got.Addr, up.Addr())
+	}
+
+	// TLS checks verify the host of the backend address by default.
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", "localhost")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNames := make(chan string, 1)
+	upTLS := tls.NewListener(newLocalListener(t), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case serverNames <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	})
+	defer upTLS.Close()
+	go func() {
+		for {
+			conn, err := upTLS.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(upTLS.Addr().String())
+	hc := &HealthCheck{Timeout: time.Second, TLS: true}
+	hc.check(ctx, To(net.JoinHostPort("localhost", port)))
+	select {
+	case name := <-serverNames:
+		if name != "localhost" {
+			t.Fatalf("check sent server name %q; want %q", name, "localhost")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("check sent no ClientHello")
+	}
+
+	// Backends dialed over TLS are checked with their TLS config, after
+	// the PROXY header they expect.
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	upPROXY := newLocalListener(t)
+	defer upPROXY.Close()
+	headers := make(chan error, 1)
+	go func() {
+		conn, err := upPROXY.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		src, _, err := readProxyHeader(br)
+		if err == nil && src != nil {
+			err = fmt.Errorf("header announces client %v", src)
+		}
+		headers <- err
+		tlsConn := tls.Server(readerConn{br, conn}, &tls.Config{Certificates: []tls.Certificate{cert}})
+		io.WriteString(tlsConn, "pong")
+	}()
+
+	_, port, _ = net.SplitHostPort(upPROXY.Addr().String())
+	hc = &HealthCheck{Timeout: time.Second, Expect: []byte("pong")}
+	err = hc.check(ctx, &DialProxy{
+		Addr:                 net.JoinHostPort("localhost", port),
+		TLSConfig:            &tls.Config{RootCAs: roots},
+		ProxyProtocolVersion: ProxyProtocolV2,
+	})
+	if err != nil {
+		t.Fatalf("check of TLS backend failed: %v", err)
+	}
+	if err := <-headers; err != nil {
+		t.Fatalf("reading PROXY header: %v", err)
+	}
+}
+
+func TestBalancerOutlierNotBackendFailures(t *testing.T) {
+	// The backend reads the request and never replies.
+	back := newLocalListener(t)
+	defer back.Close()
+	requests := make(chan struct{})
+	go func() {
+		for {
+			conn, err := back.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, 4)); err == nil {
+					requests <- struct{}{}
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		end         func(toFront *net.TCPConn)
+	}{
+		{"client reset", 0, func(toFront *net.TCPConn) {
+			toFront.SetLinger(0)
+			toFront.Close()
+		}},
+		{"idle timeout", 50 * time.Millisecond, func(toFront *net.TCPConn) {
+			toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+			ioutil.ReadAll(toFront)
+			toFront.Close()
+		}},
+	}
+	for _, tt := range tests {
+		front := newLocalListener(t)
+		defer front.Close()
+		backend := &Backend{DialProxy: &DialProxy{Addr: back.Addr().String(), IdleTimeout: tt.idleTimeout}}
+		balancer, err := NewBalancer(RoundRobin, []*Backend{backend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		balancer.OutlierDetection = &OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 100}
+		p := testProxy(t, front)
+		p.AddRoute(testFrontAddr, balancer)
+		if err := p.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		toFront, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(toFront, "ping")
+		<-requests
+		tt.end(toFront.(*net.TCPConn))
+
+		// Sessions are reported before they stop counting.
+		deadline := time.Now().Add(5 * time.Second)
+		for backend.Conns() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: session not ended", tt.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if backend.Ejected() {
+			t.Errorf("%s: backend ejected", tt.name)
+		}
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, &DialProxy{
+		Addr:        back.Addr().String(),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	io.WriteString(toFront, "a")
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	fromProxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(fromProxy); err != nil {
+		t.Fatalf("idle session not closed: %v", err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		idle, lifetime time.Duration
+		lastActive     time.Duration // after start
+		want           time.Duration // after start
+		wantReason     string
+	}{
+		{idle: 10 * time.Second, lastActive: 0, want: 10 * time.Second, wantReason: "idle for 10s"},
+		{idle: 10 * time.Second, lastActive: 25 * time.Second, want: 35 * time.Second, wantReason: "idle for 10s"},
+		{lifetime: time.Minute, lastActive: 50 * time.Second, want: time.Minute, wantReason: "max lifetime 1m0s reached"},
+		{idle: 10 * time.Second, lifetime: time.Minute, lastActive: 20 * time.Second, want: 30 * time.Second, wantReason: "idle for 10s"},
+		{idle: 10 * time.Second, lifetime: time.Minute, lastActive: 55 * time.Second, want: time.Minute, wantReason: "max lifetime 1m0s reached"},
+	}
+	for _, tt := range tests {
+		dialproxy := &DialProxy{IdleTimeout: tt.idle, MaxLifetime: tt.lifetime}
+		expiry, reason := dialproxy.sessionExpiry(start, start.Add(tt.lastActive))
+		if got := expiry.Sub(start); got != tt.want || reason != tt.wantReason {
+			t.Errorf("idle %v, lifetime %v, active at %v: got %v (%s); want %v (%s)", tt.idle, tt.lifetime, tt.lastActive, got, reason, tt.want, tt.wantReason)
+		}
+	}
+}
+
+func TestProxyPeekTimeout(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backTLS := newLocalListener(t)
+	defer backTLS.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.SetPeekTimeout(testFrontAddr, 50*time.Millisecond)
+	p.AddSNIRoute(testFrontAddr, "foo.com", To(backTLS.Addr().String()))
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client waiting for the server to speak first still gets routed.
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	const msg = "220 ready\r\n"
+	io.WriteString(fromProxy, msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(toFront, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend answers only once it read the whole request, as
+	// signaled by the client's FIN.
+	const request, response = "request", "response"
+	errc := make(chan error, 1)
+	go func() {
+		fromProxy, err := back.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer fromProxy.Close()
+		bs, err := ioutil.ReadAll(fromProxy)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if string(bs) != request {
+			errc <- fmt.Errorf("backend got %q; want %q", bs, request)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, err = io.WriteString(fromProxy, response)
+		errc <- err
+	}()
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	io.WriteString(toFront, request)
+	if err := toFront.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadAll(toFront)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != response {
+		t.Fatalf("client got %q; want %q", bs, response)
+	}
+}
+
+func TestProxyHalfCloseLinger(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, &DialProxy{
+		Addr:          back.Addr().String(),
+		LingerTimeout: 50 * time.Millisecond,
+	})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	toFront.(*net.TCPConn).CloseWrite()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	// The backend never answers; the session is closed once the linger
+	// timeout expires.
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(toFront); err != nil {
+		t.Fatalf("lingering session not closed: %v", err)
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	// An active session is waited for...
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- p.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a session in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := net.Dial("tcp", front.Addr().String()); err == nil {
+		t.Fatal("listener still accepting during Shutdown")
+	}
+
+	// ...until it ends.
+	toFront.Close()
+	fromProxy.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestProxyShutdownDeadline(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(toFront); err != nil {
+		t.Fatalf("session not closed after Shutdown deadline: %v", err)
+	}
+}
+
+func TestUDPProxy(t *testing.T) {
+	back, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := back.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			back.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+
+	balancer, err := NewBalancer(RoundRobin, []*Backend{{DialProxy: To(back.LocalAddr().String())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewUDPProxy("127.0.0.1:0", balancer)
+	p.IdleTimeout = 100 * time.Millisecond
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	client, err := net.Dial("udp", p.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 512)
+	for _, msg := range []string{"one", "two"} {
+		io.WriteString(client, msg)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "echo "+msg; got != want {
+			t.Fatalf("got %q; want %q", got, want)
+		}
+	}
+	if n := p.ActiveFlows(); n != 1 {
+		t.Fatalf("got %d flows; want 1", n)
+	}
+	if n := balancer.Backends()[0].Conns(); n != 1 {
+		t.Fatalf("backend has %d conns; want 1", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.ActiveFlows() != 0 || balancer.Backends()[0].Conns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow not ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowFlowTarget holds the dials of the flows from block until release
+// is closed.
+type slowFlowTarget struct {
+	PacketTarget
+	block   string
+	release chan struct{}
+}
+
+func (t slowFlowTarget) DialFlow(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if client.String() == t.block {
+		<-t.release
+	}
+	return t.PacketTarget.DialFlow(ctx, client)
+}
+
+func TestUDPProxySlowDial(t *testing.T) {
+	back, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := back.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			back.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+
+	slow, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	target := slowFlowTarget{
+		PacketTarget: To(back.LocalAddr().String()),
+		block:        slow.LocalAddr().String(),
+		release:      make(chan struct{}),
+	}
+	p := NewUDPProxy("127.0.0.1:0", target)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	front := p.conn.LocalAddr()
+
+	// The datagrams of the slow flow wait for its dial...
+	for _, msg := range []string{"one", "two"} {
+		slow.WriteTo([]byte(msg), front)
+	}
+
+	// ...without holding up the other clients.
+	client, err := net.Dial("udp", front.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, "fast")
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "echo fast"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+
+	close(target.release)
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"one", "two"} {
+		n, _, err := slow.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "echo "+msg; got != want {
+			t.Fatalf("got %q; want %q", got, want)
+		}
+	}
+}
+
+func TestProxyUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	back, err := net.Listen("unix", filepath.Join(dir, "back.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	frontAddr := "unix://" + filepath.Join(dir, "front.sock")
+	p := new(Proxy)
+	p.AddRoute(frontAddr, To("unix://"+back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	toFront, err := net.Dial("unix", filepath.Join(dir, "front.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	const msg = "hello"
+	io.WriteString(toFront, msg)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for names and its key to
+// dir, as base.crt and base.key. Names with a scheme are URI SANs.
+func writeTestCert(t *testing.T, dir, base string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, name := range names {
+		if uri, err := url.Parse(name); err == nil && uri.Scheme != "" {
+			template.URIs = append(template.URIs, uri)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyTerminateTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "wild", "*.example.com")
+	writeTestCert(t, dir, "foo", "foo.com")
+	// A CA bundle, without a key, is not served but does not fail the
+	// directory.
+	wild, err := ioutil.ReadFile(filepath.Join(dir, "wild.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), wild, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defaultDir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(defaultDir)
+	writeTestCert(t, defaultDir, "default", "default.local")
+
+	store := NewCertStore()
+	if err := store.AddDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDefault(filepath.Join(defaultDir, "default.crt"), filepath.Join(defaultDir, "default.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.TerminateTLS(testFrontAddr, &tls.Config{GetCertificate: store.GetCertificate})
+	p.AddSNIRoute(testFrontAddr, "*.example.com", To(back.Addr().String()))
+	p.AddRoute(testFrontAddr, To(back.Addr().String()))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dialName := func(serverName string) (*tls.Conn, string) {
+		conn, err := tls.Dial("tcp", front.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.ConnectionState().PeerCertificates[0].DNSNames[0]
+	}
+
+	for serverName, want := range map[string]string{
+		"a.example.com": "*.example.com",
+		"FOO.com":       "foo.com",
+		"bar.com":       "default.local",
+	} {
+		conn, got := dialName(serverName)
+		conn.Close()
+		if got != want {
+			t.Errorf("for %s got certificate for %s; want %s", serverName, got, want)
+		}
+		fromProxy, err := back.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromProxy.Close()
+	}
+
+	// The backend gets the plaintext.
+	conn, _ := dialName("a.example.com")
+	defer conn.Close()
+	const msg = "GET / HTTP/1.1\r\n\r\n"
+	io.WriteString(conn, msg)
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+
+	// Certificates changed on disk are served once reloaded.
+	writeTestCert(t, dir, "foo", "foo.com", "foo.net")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	renewed, got := dialName("foo.net")
+	renewed.Close()
+	if got != "foo.com" {
+		t.Fatalf("got certificate for %s after reload; want foo.com", got)
+	}
+}
+
+func TestDialProxyTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", "localhost")
+	writeTestCert(t, dir, "client", "client")
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCA, clientCA := x509.NewCertPool(), x509.NewCertPool()
+	serverLeaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	clientLeaf, _ := x509.ParseCertificate(clientCert.Certificate[0])
+	serverCA.AddCert(serverLeaf)
+	clientCA.AddCert(clientLeaf)
+
+	front := newLocalListener(t)
+	defer front.Close()
+	back := tls.NewListener(newLocalListener(t), &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCA,
+	})
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddRoute(testFrontAddr, &DialProxy{
+		Addr: back.Addr().String(),
+		TLSConfig: &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      serverCA,
+			Certificates: []tls.Certificate{clientCert},
+		},
+	})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	const msg = "plaintext"
+	io.WriteString(toFront, msg)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+	state := fromProxy.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "client" {
+		t.Fatal("backend got no client certificate")
+	}
+
+	// A PROXY header goes in cleartext, before the ClientHello.
+	frontPROXY := newLocalListener(t)
+	defer frontPROXY.Close()
+	backPROXY := newLocalListener(t)
+	defer backPROXY.Close()
+
+	p = testProxy(t, frontPROXY)
+	p.AddRoute(testFrontAddr, &DialProxy{
+		Addr:                 backPROXY.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV1,
+		TLSConfig:            &tls.Config{ServerName: "localhost", RootCAs: serverCA},
+	})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	toFrontPROXY, err := net.Dial("tcp", frontPROXY.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFrontPROXY.Close()
+
+	fromProxyPROXY, err := backPROXY.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxyPROXY.Close()
+	br := bufio.NewReader(fromProxyPROXY)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "PROXY TCP4 ") {
+		t.Fatalf("got %q; want a cleartext PROXY header", line)
+	}
+	if clientHello(br) == nil {
+		t.Fatal("backend did not receive a ClientHello after the PROXY header")
+	}
+}
+
+func TestProxyClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", "localhost")
+	writeTestCert(t, dir, "billing", "billing", "spiffe://example.org/billing")
+	writeTestCert(t, dir, "other", "other", "spiffe://other.org/web")
+	loadCert := func(base string) tls.Certificate {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, base+".crt"), filepath.Join(dir, base+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		return cert
+	}
+	serverCert, billing, other := loadCert("server"), loadCert("billing"), loadCert("other")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(billing.Leaf)
+	clientCAs.AddCert(other.Leaf)
+
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.TerminateTLS(testFrontAddr, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	p.AddClientCertRoute(testFrontAddr, SPIFFEIDMatcher("spiffe://example.org/*"), &DialProxy{
+		Addr:                 back.Addr().String(),
+		ProxyProtocolVersion: ProxyProtocolV2,
+	})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(cert tls.Certificate) *tls.Conn {
+		conn, err := tls.Dial("tcp", front.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{cert},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// A certificate outside the trust domain matches no route.
+	rejected := dial(other)
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes; want the connection closed", n)
+	}
+	rejected.Close()
+
+	accepted := dial(billing)
+	defer accepted.Close()
+	io.WriteString(accepted, "x")
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	br := bufio.NewReader(fromProxy)
+	if _, _, err := readProxyHeader(br); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := br.ReadByte(); err != nil || b != 'x' {
+		t.Fatalf("got %q, %v after the PROXY header; want x", b, err)
+	}
+
+	// The identity is forwarded in the TLVs of the header.
+	fromProxy.Close()
+	accepted.Close()
+	client := &Conn{TLS: &tls.ConnectionState{
+		Version:        tls.VersionTLS13,
+		VerifiedChains: [][]*x509.Certificate{{billing.Leaf}},
+	}}
+	var tlvs bytes.Buffer
+	writeSSLTLVs(&tlvs, client)
+	for _, want := range []string{"TLSv1.3", "billing", "spiffe://example.org/billing"} {
+		if !bytes.Contains(tlvs.Bytes(), []byte(want)) {
+			t.Errorf("TLVs %q lack %q", tlvs.Bytes(), want)
+		}
+	}
+	if tlvs.Bytes()[0] != proxyV2TypeSSL || tlvs.Bytes()[3] != proxyV2ClientSSL|proxyV2ClientCertConn {
+		t.Errorf("got SSL TLV %x", tlvs.Bytes())
+	}
+}
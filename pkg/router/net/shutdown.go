@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all
+// connections are done.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// trackConn adds conn to or removes it from the connections being
+// served. Adding fails once the proxy is shutting down.
+func (proxy *Proxy) trackConn(conn net.Conn, add bool) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if !add {
+		delete(proxy.conns, conn)
+		return true
+	}
+	if proxy.shuttingDown {
+		return false
+	}
+	if proxy.conns == nil {
+		proxy.conns = make(map[net.Conn]struct{})
+	}
+	proxy.conns[conn] = struct{}{}
+	return true
+}
+
+// ActiveConns returns the number of connections being served.
+func (proxy *Proxy) ActiveConns() int {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return len(proxy.conns)
+}
+
+// Shutdown gracefully shuts down the proxy: it closes all listeners,
+// then waits for the connections being served to finish. If ctx expires
+// first, the remaining connections are closed and ctx's error returned.
+func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	proxy.mu.Lock()
+	proxy.shuttingDown = true
+	proxy.mu.Unlock()
+
+	proxy.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if proxy.ActiveConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			proxy.closeConns()
+			return ctx.Err()
+		}
+	}
+}
+
+// closeConns force-closes the connections being served.
+func (proxy *Proxy) closeConns() {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	for conn := range proxy.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// AddSNIRoute appends a route to the ipPort listener that routes to
+// dest if the incoming TLS SNI server name is sni. sni may be a wildcard
+// like "*.example.com", matching exactly one leading label.
+//
+// The connection is not terminated; the TLS ClientHello is replayed to dest.
+// On listeners terminating TLS (see TerminateTLS), the server name of the
+// terminated connection is matched and the plaintext forwarded instead.
+func (proxy *Proxy) AddSNIRoute(ipPort, sni string, dest Target) {
+	proxy.addRoute(ipPort, SNIRoute(sni, dest))
+}
+
+// AddSNIMatchRoute appends a route to the ipPort listener that routes to
+// dest if the incoming TLS SNI server name is accepted by matcher.
+func (proxy *Proxy) AddSNIMatchRoute(ipPort string, matcher Matcher, dest Target) {
+	proxy.addRoute(ipPort, SNIMatchRoute(matcher, dest))
+}
+
+// SNIRoute returns the Route of AddSNIRoute, for use with SetRoute.
+func SNIRoute(sni string, dest Target) Route {
+	return sniMatch{hostNameMatcher(sni), dest}
+}
+
+// SNIMatchRoute returns the Route of AddSNIMatchRoute, for use with
+// SetRoute.
+func SNIMatchRoute(matcher Matcher, dest Target) Route {
+	return sniMatch{matcher, dest}
+}
+
+type sniMatch struct {
+	matcher Matcher
+	target  Target
+}
+
+func (m sniMatch) match(ctx context.Context, conn *Conn, br *bufio.Reader) Target {
+	if conn.TLS != nil {
+		// Terminated by the proxy; the ClientHello is gone.
+		if m.matcher(ctx, conn.TLS.ServerName) {
+			return m.target
+		}
+		return nil
+	}
+	hello := clientHello(br)
+	if hello == nil {
+		return nil
+	}
+	conn.HostName = hello.ServerName
+	conn.ALPN = hello.SupportedProtos
+	if m.matcher(ctx, hello.ServerName) {
+		return m.target
+	}
+	return nil
+}
+
+// hostNameMatcher returns a Matcher for an exact ("example.com") or
+// wildcard ("*.example.com") host name pattern, compared case-insensitively.
+func hostNameMatcher(pattern string) Matcher {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return func(ctx context.Context, hostname string) bool {
+			hostname = strings.ToLower(hostname)
+			if !strings.HasSuffix(hostname, suffix) {
+				return false
+			}
+			label := hostname[:len(hostname)-len(suffix)]
+			return label != "" && !strings.Contains(label, ".")
+		}
+	}
+	return func(ctx context.Context, hostname string) bool {
+		return strings.ToLower(hostname) == pattern
+	}
+}
+
+// clientHello peeks the TLS ClientHello from br without consuming it.
+// It returns nil if the buffered bytes are not a TLS handshake, or if the
+// ClientHello record doesn't fit in br's buffer (peekBufferSize on
+// listeners). ClientHellos split across records are not supported.
+func clientHello(br *bufio.Reader) (hello *tls.ClientHelloInfo) {
+	const recordHeaderLen = 5
+	hdr, err := br.Peek(recordHeaderLen)
+	if err != nil {
+		return nil
+	}
+	const recordTypeHandshake = 0x16
+	if hdr[0] != recordTypeHandshake {
+		return nil
+	}
+	recLen := int(hdr[3])<<8 | int(hdr[4])
+	helloBytes, err := br.Peek(recordHeaderLen + recLen)
+	if err != nil {
+		return nil
+	}
+
+	// Let crypto/tls do the parsing; the handshake is aborted as soon as
+	// the ClientHello has been read.
+	tls.Server(sniffConn{r: bytes.NewReader(helloBytes)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errSniffed
+		},
+	}).Handshake()
+
+	return hello
+}
+
+var errSniffed = errors.New("client hello sniffed")
+
+// sniffConn is a net.Conn that reads from r and fails all writes.
+// Only Read and Write may be called on it.
+type sniffConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (c sniffConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (sniffConn) Write(p []byte) (int, error)  { return 0, io.EOF }
@@ -0,0 +1,86 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SetPeekTimeout bounds the time the ipPort listener waits for the
+// bytes its routes match on, including any PROXY protocol header. Once it
+// expires, routes only see what was received so far. Zero waits forever,
+// except on listeners with protocol routes (see AddProtocolRoute).
+// It must be called before Start.
+func (proxy *Proxy) SetPeekTimeout(ipPort string, timeout time.Duration) {
+	proxy.configFor(ipPort).peekTimeout = timeout
+}
+
+// loadPeekTimeout returns the peek timeout of the listener for a new
+// connection, given its current routes.
+func (cfg *routerConfig) loadPeekTimeout() time.Duration {
+	if cfg.peekTimeout <= 0 && hasProtocolRoutes(cfg.loadRoutes()) {
+		return protocolPeekTimeout
+	}
+	return cfg.peekTimeout
+}
+
+// activityConn is a net.Conn storing the time of its last read.
+type activityConn struct {
+	net.Conn
+	last *int64 // unix nanoseconds, accessed atomically
+}
+
+func (c activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watchSession closes src and dst once the session exceeds IdleTimeout
+// or MaxLifetime, unless done is closed first, setting expired before.
+// activity holds the time of the last read on either side.
+func (dialproxy *DialProxy) watchSession(done <-chan struct{}, src, dst net.Conn, activity *int64, expired *int32) {
+	start := time.Now()
+	atomic.StoreInt64(activity, start.UnixNano())
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		expiry, reason := dialproxy.sessionExpiry(start, time.Unix(0, atomic.LoadInt64(activity)))
+		now := time.Now()
+		if !now.Before(expiry) {
+			fmt.Printf("for incoming conn %v, closing session with %q: %s\n", src.RemoteAddr().String(), dialproxy.Addr, reason)
+			break
+		}
+		timer.Reset(expiry.Sub(now))
+	}
+
+	atomic.StoreInt32(expired, 1)
+	goCloseConn(src)
+	goCloseConn(dst)
+}
+
+// sessionExpiry returns when a session started at start and last active
+// at lastActive expires, at the first of MaxLifetime and IdleTimeout, and
+// why. At least one of them must be set.
+func (dialproxy *DialProxy) sessionExpiry(start, lastActive time.Time) (expiry time.Time, reason string) {
+	if lifetime := dialproxy.MaxLifetime; lifetime > 0 {
+		expiry, reason = start.Add(lifetime), fmt.Sprintf("max lifetime %v reached", lifetime)
+	}
+	if idle := dialproxy.IdleTimeout; idle > 0 {
+		if idleAt := lastActive.Add(idle); expiry.IsZero() || idleAt.Before(expiry) {
+			expiry, reason = idleAt, fmt.Sprintf("idle for %v", idle)
+		}
+	}
+	return expiry, reason
+}
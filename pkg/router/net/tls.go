@@ -0,0 +1,44 @@
+package http
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// TerminateTLS makes the ipPort listener terminate TLS with config, after
+// reading any PROXY protocol header. Routes then match the plaintext,
+// and targets get it too: a DialProxy forwards it as is. Certificates are
+// typically served from a CertStore:
+//
+//	proxy.TerminateTLS(":443", &tls.Config{GetCertificate: store.GetCertificate})
+//
+// Handshakes taking longer than the peek timeout, or 10 seconds without
+// one, are closed. It must be called before Start.
+func (proxy *Proxy) TerminateTLS(ipPort string, config *tls.Config) {
+	proxy.configFor(ipPort).tlsConfig = config
+}
+
+// tlsHandshakeTimeout bounds the TLS handshake of clients on listeners
+// without a peek timeout.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// terminateTLS performs the server side TLS handshake on conn, whose
+// first bytes may already be buffered in br.
+func terminateTLS(br *bufio.Reader, conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(readerConn{br, conn}, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// readerConn is a net.Conn reading from r instead of Conn.
+type readerConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (c readerConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,337 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketTarget is what the datagrams of a UDP client flow are proxied to.
+type PacketTarget interface {
+	// DialFlow returns the connection the datagrams of the flow from
+	// client are sent on, and its replies read from. The flow is over
+	// once the connection is closed.
+	DialFlow(ctx context.Context, client net.Addr) (net.Conn, error)
+}
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 64 << 10
+
+// UDPProxy forwards the datagrams received on a UDP address to a
+// PacketTarget. Datagrams are grouped in flows by client address: each
+// flow gets its own connection to the target, so replies find their way
+// back to the client, and ends once idle for IdleTimeout.
+type UDPProxy struct {
+	// Addr is the address to listen on.
+	Addr string
+	// IdleTimeout ends flows in which no datagram went either way for
+	// that long. If zero, a default of 60 seconds is used.
+	IdleTimeout time.Duration
+	// ListenPacketFunc optionally specifies an alternate listen function.
+	ListenPacketFunc func(network, address string) (net.PacketConn, error)
+
+	target atomic.Value // PacketTarget
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	flows  map[string]*udpFlow // by client address
+	closed bool
+	donec  chan struct{}
+}
+
+// NewUDPProxy returns a UDPProxy forwarding the datagrams received on
+// addr to target.
+func NewUDPProxy(addr string, target PacketTarget) *UDPProxy {
+	proxy := &UDPProxy{Addr: addr}
+	proxy.SetTarget(target)
+	return proxy
+}
+
+// SetTarget replaces the target of new flows. It is safe to call on a
+// running UDPProxy; established flows keep their target.
+func (proxy *UDPProxy) SetTarget(target PacketTarget) {
+	proxy.target.Store(&target)
+}
+
+func (proxy *UDPProxy) loadTarget() PacketTarget {
+	if target, ok := proxy.target.Load().(*PacketTarget); ok {
+		return *target
+	}
+	return nil
+}
+
+func (proxy *UDPProxy) idleTimeout() time.Duration {
+	if proxy.IdleTimeout > 0 {
+		return proxy.IdleTimeout
+	}
+	return 60 * time.Second
+}
+
+func (proxy *UDPProxy) listenPacket() func(network, address string) (net.PacketConn, error) {
+	if proxy.ListenPacketFunc != nil {
+		return proxy.ListenPacketFunc
+	}
+	return net.ListenPacket
+}
+
+// Start listens on Addr and serves it until Close or Shutdown.
+func (proxy *UDPProxy) Start(ctx context.Context) error {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if proxy.donec != nil {
+		return errors.New("already started")
+	}
+	conn, err := proxy.listenPacket()("udp", proxy.Addr)
+	if err != nil {
+		return err
+	}
+	proxy.conn = conn
+	proxy.flows = make(map[string]*udpFlow)
+	proxy.donec = make(chan struct{})
+
+	go proxy.serve(ctx, conn)
+	return nil
+}
+
+// Wait waits for the UDPProxy to finish running.
+func (proxy *UDPProxy) Wait() {
+	<-proxy.donec
+}
+
+// Close stops listening and ends every flow.
+func (proxy *UDPProxy) Close() error {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.closed = true
+	if proxy.conn == nil {
+		return nil
+	}
+	err := proxy.conn.Close()
+	for _, flow := range proxy.flows {
+		if flow.backend != nil {
+			flow.backend.Close()
+		}
+	}
+	return err
+}
+
+// Shutdown stops listening and ends every flow. UDP carries no notion
+// of a finished exchange, so there is nothing to wait for; ctx is
+// accepted for symmetry with Proxy.Shutdown.
+func (proxy *UDPProxy) Shutdown(ctx context.Context) error {
+	return proxy.Close()
+}
+
+// ActiveFlows returns the number of client flows being proxied.
+func (proxy *UDPProxy) ActiveFlows() int {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return len(proxy.flows)
+}
+
+func (proxy *UDPProxy) serve(ctx context.Context, conn net.PacketConn) {
+	defer close(proxy.donec)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !proxy.forward(ctx, client, buf[:n]) {
+			return
+		}
+	}
+}
+
+// maxPendingDatagrams is how many datagrams of a new flow are held while
+// its target is dialed; more are dropped.
+const maxPendingDatagrams = 16
+
+// udpFlow is the datagram exchange of a client with its target.
+type udpFlow struct {
+	client     net.Addr
+	lastActive int64 // unix nanoseconds, accessed atomically
+
+	// Guarded by the UDPProxy mu.
+	backend net.Conn // nil while dialing
+	pending [][]byte // received while dialing
+}
+
+// forward sends datagram from client on to its flow, starting a new flow
+// if client has none. Flows are dialed in the background, so that a slow
+// target does not hold up the other clients. It returns false once the
+// proxy is closed.
+func (proxy *UDPProxy) forward(ctx context.Context, client net.Addr, datagram []byte) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if proxy.closed {
+		return false
+	}
+	key := client.String()
+	flow := proxy.flows[key]
+	if flow == nil {
+		flow = &udpFlow{client: client}
+		proxy.flows[key] = flow
+		go proxy.dialFlow(ctx, flow)
+	}
+	atomic.StoreInt64(&flow.lastActive, time.Now().UnixNano())
+
+	if flow.backend == nil {
+		if len(flow.pending) < maxPendingDatagrams {
+			flow.pending = append(flow.pending, append([]byte(nil), datagram...))
+		}
+		return true
+	}
+	if _, err := flow.backend.Write(datagram); err != nil {
+		fmt.Printf("for incoming flow %v, error forwarding datagram: %v\n", client, err)
+	}
+	return true
+}
+
+// dialFlow dials the target of flow, then sends it the datagrams received
+// meanwhile and relays its replies.
+func (proxy *UDPProxy) dialFlow(ctx context.Context, flow *udpFlow) {
+	var backend net.Conn
+	err := errors.New("no target")
+	if target := proxy.loadTarget(); target != nil {
+		backend, err = target.DialFlow(ctx, flow.client)
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("for incoming flow %v, error dialing target: %v\n", flow.client, err)
+		proxy.removeFlow(flow)
+		return
+	}
+	if proxy.closed {
+		proxy.removeFlow(flow)
+		backend.Close()
+		return
+	}
+	flow.backend = backend
+	for _, datagram := range flow.pending {
+		if _, err := backend.Write(datagram); err != nil {
+			fmt.Printf("for incoming flow %v, error forwarding datagram: %v\n", flow.client, err)
+		}
+	}
+	flow.pending = nil
+
+	go proxy.serveFlow(flow)
+}
+
+// removeFlow forgets flow, unless it was already replaced. The caller
+// holds mu.
+func (proxy *UDPProxy) removeFlow(flow *udpFlow) {
+	key := flow.client.String()
+	if proxy.flows[key] == flow {
+		delete(proxy.flows, key)
+	}
+}
+
+// expire removes flow if it is idle for IdleTimeout. It is checked under
+// mu so that a datagram forwarded meanwhile either keeps the flow alive
+// or starts a new one, and is never written to a closed connection.
+func (proxy *UDPProxy) expire(flow *udpFlow, idle time.Duration) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	last := time.Unix(0, atomic.LoadInt64(&flow.lastActive))
+	if time.Since(last) < idle {
+		return false
+	}
+	proxy.removeFlow(flow)
+	return true
+}
+
+// serveFlow relays the replies of flow's target to its client until the
+// flow is idle for IdleTimeout or its connection fails.
+func (proxy *UDPProxy) serveFlow(flow *udpFlow) {
+	defer func() {
+		proxy.mu.Lock()
+		proxy.removeFlow(flow)
+		proxy.mu.Unlock()
+		flow.backend.Close()
+	}()
+
+	idle := proxy.idleTimeout()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		last := time.Unix(0, atomic.LoadInt64(&flow.lastActive))
+		if time.Since(last) >= idle && proxy.expire(flow, idle) {
+			return
+		}
+		flow.backend.SetReadDeadline(last.Add(idle))
+
+		n, err := flow.backend.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Client datagrams may have moved lastActive meanwhile.
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&flow.lastActive, time.Now().UnixNano())
+		if _, err := proxy.conn.WriteTo(buf[:n], flow.client); err != nil {
+			return
+		}
+	}
+}
+
+// DialFlow dials Addr over UDP for the flow from client, within
+// DialTimeout.
+func (dialproxy *DialProxy) DialFlow(ctx context.Context, client net.Addr) (net.Conn, error) {
+	var cancel context.CancelFunc
+	if dialproxy.DialTimeout >= 0 {
+		ctx, cancel = context.WithTimeout(ctx, dialproxy.dialTimeout())
+		defer cancel()
+	}
+	return dialproxy.dialContext()(ctx, "udp", dialproxy.Addr)
+}
+
+// DialFlow connects the flow from client to the backend chosen by the
+// balancing strategy. The flow counts as a connection of the backend
+// until the returned connection is closed.
+func (balancer *Balancer) DialFlow(ctx context.Context, client net.Addr) (net.Conn, error) {
+	// Strategies look at connections; hand them one from client.
+	src := &Conn{remoteAddr: client}
+	backend := balancer.strategy.pick(src, balancer.available())
+	if backend == nil {
+		return nil, ErrNoBackend
+	}
+
+	conn, err := backend.DialFlow(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&backend.conns, 1)
+	return &flowConn{Conn: conn, backend: backend}, nil
+}
+
+// flowConn is the connection of a flow to a balancer's backend.
+type flowConn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+func (c *flowConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.conns, -1)
+	})
+	return c.Conn.Close()
+}